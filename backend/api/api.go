@@ -1,31 +1,309 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 
 	"github.com/MaT1g3R/slaytherelics/client"
+	"github.com/MaT1g3R/slaytherelics/models"
 	"github.com/MaT1g3R/slaytherelics/o11y"
 	"github.com/MaT1g3R/slaytherelics/slaytherelics"
 )
 
+// Users authenticates streamers, it is implemented by slaytherelics.Users.
+type Users interface {
+	AuthenticateTwitch(ctx context.Context, code string) (models.User, string, error)
+	AuthenticateRedis(ctx context.Context, userID, token string) (models.User, error)
+	UserAuth(ctx context.Context, login string, secret string) (bool, error)
+	GetUserID(ctx context.Context, login string) (string, error)
+}
+
 type API struct {
 	Router *gin.Engine
 
 	twitch      *client.Twitch
-	users       *slaytherelics.Users
+	users       Users
 	broadcaster *slaytherelics.Broadcaster
 
-	deckLists map[string]string
-	deckLock  *sync.RWMutex
+	parser  parser
+	devMode bool
+	jsonp   bool
+
+	// deckLists maps names to their deck, decks maps compressed deck hashes to the deck shared by every name storing it.
+	deckLists map[string]*deckEntry
+	decks     map[[sha256.Size]byte]*deck
+	// staleWhileRevalidate serves the replaced deck of a name until the deck replacing it is parsed.
+	staleWhileRevalidate bool
+	// shortHashes maps the short hash of every stored deck to the deck, the first deck stored keeping a shared short
+	// hash.
+	shortHashes map[string]*deck
+	// generation is the generation of the last deck stored.
+	generation uint64
+	// evicted holds the recently evicted names along with when they were evicted.
+	evicted  map[string]time.Time
+	deckTTL  time.Duration
+	maxDecks int
+	deckLock *sync.RWMutex
+	// missingDeckStatus is the status code of responses for decks that aren't stored.
+	missingDeckStatus int
+	// defaultDeck is served for the names that were never stored, if set.
+	defaultDeck *deckEntry
+	// etagHash is the hash of the ETags of rendered decks.
+	etagHash ETagHash
+
+	streams *deckHub
+	stats   *serverStats
+	// streamsByIP counts the open streams of every remote IP, capped at maxStreamsPerIP unless it's zero.
+	streamsByIP     map[string]int
+	maxStreamsPerIP int
+	streamLock      *sync.Mutex
+	// adminLogins are the lowercase logins of the streamers allowed to use the admin endpoints.
+	adminLogins map[string]struct{}
+	// metricNames are the names labelled individually in metrics.
+	metricNames map[string]struct{}
+	// allowedNames and deniedNames are the lowercase glob patterns of the deck names accepted for upload.
+	allowedNames []string
+	deniedNames  []string
+
+	uploads    map[string]*chunkedUpload
+	uploadTTL  time.Duration
+	uploadLock *sync.Mutex
+
+	// batchTimeout bounds the time spent parsing the decks of a batch request.
+	batchTimeout time.Duration
+
+	// clock tells the time of deck accesses and upload chunks.
+	clock clock
+	// translations map the languages decks can be translated to to their card name translations.
+	translations map[string]map[string]string
+	// draining is set by Shutdown, new requests are rejected from then on.
+	draining atomic.Bool
+	// drainGracePeriod is how long Shutdown rejects new requests before closing the listeners.
+	drainGracePeriod time.Duration
+}
+
+// Options configures the optional behaviour of the API. The zero value uses the defaults.
+type Options struct {
+	// Format overrides the separators of the compressed deck encoding.
+	Format Format
+	// MaxIndices limits the number of card indices in a deck, defaults to 2000.
+	MaxIndices int
+	// MaxUniqueCards limits the number of distinct cards in a deck, defaults to 500.
+	MaxUniqueCards int
+	// MaxDictEntryLength limits the length in bytes of every compression dictionary entry, defaults to 4096.
+	MaxDictEntryLength int
+	// ExpectedMaxDeckSize is the number of cards above which a deck is counted and logged as oversized, as no real
+	// deck gets this large without a serialization bug. Defaults to 1000.
+	ExpectedMaxDeckSize int
+	// Strict rejects decks whose encoding is valid but suggests a serialization bug, such as unused dictionary entries.
+	Strict bool
+	// MaxRenderedSize rejects decks whose plain text rendering, header and footer included, is larger than this many
+	// bytes with a 413, as overlays can't display such a deck anyway. Unlimited when zero.
+	MaxRenderedSize int
+	// MaxConcurrentParses bounds the number of decks parsed at once, so a burst of cold decks can't saturate the CPU.
+	// Defaults to GOMAXPROCS.
+	MaxConcurrentParses int
+	// RejectMissingWildcards rejects decks whose body references dictionary entries past the end of the dictionary,
+	// which would otherwise be left verbatim in the card text.
+	RejectMissingWildcards bool
+	// StripCR removes carriage returns from uploaded decks before decoding them, for decks written with Windows line
+	// endings.
+	StripCR bool
+	// CardNames renames cards, such as modded cards renamed to the names the overlay has assets for. Cards renamed
+	// to the same name are counted together.
+	CardNames map[string]string
+	// NameCasing selects whether card names differing only by case are counted as one card, and with which casing.
+	NameCasing NameCasing
+	// PinnedCards are card names listed after every other card, in this order, after the DefaultPinnedCards.
+	PinnedCards []string
+	// NoDefaultPins leaves out the DefaultPinnedCards, which are specific to Slay the Spire, for decks of other games.
+	// The cards are then listed in alphabetical order followed only by the PinnedCards.
+	NoDefaultPins bool
+	// InvalidUTF8 selects whether card names that aren't valid UTF-8 are kept as they are (the default), rejected, or
+	// sanitized with replacement characters.
+	InvalidUTF8 InvalidUTF8
+	// ETagHash selects the hash of the ETags of rendered decks, FNV (the default) or SHA-256 for deployments wanting
+	// collision resistance. Changing it changes every ETag, so it should stay the same across the servers of a
+	// deployment.
+	ETagHash ETagHash
+	// SkipEmptySlots ignores the card indices equal to EmptySlotSentinel, which some mods use for removed deck slots,
+	// instead of rejecting them as out of bounds.
+	SkipEmptySlots bool
+	// EmptySlotSentinel is the card index of an empty deck slot, defaults to -1 when nil. It must be negative, or 0
+	// for mods serializing 1-based indices, whose first card is 1.
+	EmptySlotSentinel *int
+	// IndexBase is the index of the first card in the card indices, 0 (the default) or 1 for mods serializing 1-based
+	// indices. EmptySlotSentinel is compared before the base is subtracted.
+	IndexBase int
+	// UniqueIndices counts every card index once however many times the deck lists it, for mods whose indices are
+	// card instances rather than references to a card definition, so a slot listed twice doesn't count double.
+	UniqueIndices bool
+	// Header and Footer are lines written above and below the card list of plain text decks, such as a title. Their
+	// "{total}" and "{unique}" are replaced by the number of cards listed and of distinct cards among them.
+	Header string
+	Footer string
+	// JSONP wraps JSON deck responses in the function named by a "callback" query parameter, for legacy overlays.
+	JSONP bool
+	// MetricNames are the names labelled individually in metrics, every other name shares the "other" label.
+	MetricNames []string
+	// AllowedNames are the deck names accepted for upload, as exact names or path.Match globs such as "team_*". Every
+	// name is accepted when empty.
+	AllowedNames []string
+	// DeniedNames are the deck names rejected for upload with a 403 even if allowed, such as abusive names or names
+	// reserved for routes like "healthz", as exact names or path.Match globs.
+	DeniedNames []string
+	// Admin serves the admin endpoints, such as the server stats, clearing the stored decks and evicting a deck.
+	Admin bool
+	// AdminLogins are the streamers allowed to use the admin endpoints, authenticating with the basic auth credentials
+	// of their deck uploads. Admin requires at least one.
+	AdminLogins []string
+	// MaxStreamsPerIP bounds the number of deck streams open at once from a remote IP, rejecting more with a 429.
+	// Unlimited when zero.
+	MaxStreamsPerIP int
+	// StaleWhileRevalidate serves the previous deck of a name while the deck replacing it is parsed in the background,
+	// instead of having readers wait for the parse. Uploaded decks are parsed before replacing the previous deck
+	// already, this covers decks stored before they're parsed.
+	StaleWhileRevalidate bool
+	// MiddlewareBeforeO11y and MiddlewareAfterO11y are extra middleware run on every request, in order, before and
+	// after the o11y middleware. Requests aborted before o11y aren't traced nor counted in metrics, which suits
+	// middleware such as rate limiting, while middleware after it sees the request span, which suits auth or logging.
+	MiddlewareBeforeO11y []gin.HandlerFunc
+	MiddlewareAfterO11y  []gin.HandlerFunc
+	// BasePath prefixes every route, for deployments behind a path based router. It must start with a slash.
+	BasePath string
+	// GinDebug adds gin's request logger. Gin's mode is global to the process, so it's set once with gin.SetMode by
+	// the caller rather than by every API.
+	GinDebug bool
+	// DevMode returns internal error details in responses instead of only logging them.
+	DevMode bool
+	// DeckTTL evicts decks that haven't been stored or read for this long, eviction is disabled when zero.
+	DeckTTL time.Duration
+	// MaxDecks evicts the least recently accessed decks beyond this many, unlimited when zero.
+	MaxDecks int
+	// UploadTTL is how long a chunked deck upload is kept without receiving a chunk, defaults to 5 minutes.
+	UploadTTL time.Duration
+	// DrainGracePeriod is how long Shutdown keeps rejecting new requests with a 503 and serving the health check before
+	// closing the listeners, so load balancers stop sending it requests first. The listeners close right away when
+	// zero.
+	DrainGracePeriod time.Duration
+	// BatchTimeout is how long a batch deck request waits for its decks to parse, the decks still parsing then being
+	// reported as timed out instead, defaults to 5 seconds.
+	BatchTimeout time.Duration
+	// MissingDeckStatus is the status code returned for decks that aren't stored, one of 404 (the default), 200 with
+	// the same error body, or 204 with no body, for overlays behind CDNs that cache 404s.
+	MissingDeckStatus int
+	// DefaultDeck is a compressed deck served for the names that were never stored instead of the missing deck status,
+	// such as a starter deck so overlays show something while being set up.
+	DefaultDeck string
+
+	// clock replaces the system clock, for tests.
+	clock clock
+}
+
+// validate checks opts, so misconfigurations fail at construction rather than misbehave later.
+func (opts Options) validate() error {
+	if err := opts.Format.withDefaults().validate(); err != nil {
+		return err
+	}
+	if opts.BasePath != "" && (!strings.HasPrefix(opts.BasePath, "/") || strings.HasSuffix(opts.BasePath, "/")) {
+		return fmt.Errorf("base path must start and not end with a slash, got %q", opts.BasePath)
+	}
+	if opts.MaxIndices < 0 {
+		return fmt.Errorf("max indices must not be negative, got %d", opts.MaxIndices)
+	}
+	if opts.MaxStreamsPerIP < 0 {
+		return fmt.Errorf("max streams per IP must not be negative, got %d", opts.MaxStreamsPerIP)
+	}
+	if opts.MaxUniqueCards < 0 {
+		return fmt.Errorf("max unique cards must not be negative, got %d", opts.MaxUniqueCards)
+	}
+	if opts.MaxDictEntryLength < 0 {
+		return fmt.Errorf("max dictionary entry length must not be negative, got %d", opts.MaxDictEntryLength)
+	}
+	if opts.MaxRenderedSize < 0 {
+		return fmt.Errorf("max rendered size must not be negative, got %d", opts.MaxRenderedSize)
+	}
+	if opts.MaxConcurrentParses < 0 {
+		return fmt.Errorf("max concurrent parses must not be negative, got %d", opts.MaxConcurrentParses)
+	}
+	if opts.ExpectedMaxDeckSize < 0 {
+		return fmt.Errorf("expected max deck size must not be negative, got %d", opts.ExpectedMaxDeckSize)
+	}
+	if opts.NameCasing < NameCasingExact || opts.NameCasing > NameCasingSmallest {
+		return fmt.Errorf("unknown name casing %d", opts.NameCasing)
+	}
+	if opts.InvalidUTF8 < InvalidUTF8Keep || opts.InvalidUTF8 > InvalidUTF8Replace {
+		return fmt.Errorf("unknown invalid UTF-8 handling %d", opts.InvalidUTF8)
+	}
+	if opts.ETagHash < ETagHashFNV || opts.ETagHash > ETagHashSHA256 {
+		return fmt.Errorf("unknown ETag hash %d", opts.ETagHash)
+	}
+	if s := opts.EmptySlotSentinel; s != nil && (*s > 0 || (*s == 0 && opts.IndexBase == 0)) {
+		return fmt.Errorf("empty slot sentinel must be negative, or 0 with an index base of 1, got %d", *s)
+	}
+	if opts.IndexBase != 0 && opts.IndexBase != 1 {
+		return fmt.Errorf("index base must be 0 or 1, got %d", opts.IndexBase)
+	}
+	for _, patterns := range [][]string{opts.AllowedNames, opts.DeniedNames} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid deck name pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if opts.DeckTTL < 0 {
+		return fmt.Errorf("deck TTL must not be negative, got %s", opts.DeckTTL)
+	}
+	if opts.MaxDecks < 0 {
+		return fmt.Errorf("max decks must not be negative, got %d", opts.MaxDecks)
+	}
+	if opts.DrainGracePeriod < 0 {
+		return fmt.Errorf("drain grace period must not be negative, got %s", opts.DrainGracePeriod)
+	}
+	if opts.UploadTTL < 0 {
+		return fmt.Errorf("upload TTL must not be negative, got %s", opts.UploadTTL)
+	}
+	if opts.Admin && len(opts.AdminLogins) == 0 {
+		return errors.New("admin endpoints need at least one admin login")
+	}
+	switch opts.MissingDeckStatus {
+	case 0, 200, 204, 404:
+	default:
+		return fmt.Errorf("unsupported missing deck status %d", opts.MissingDeckStatus)
+	}
+	return nil
 }
 
-func New(t *client.Twitch, u *slaytherelics.Users, b *slaytherelics.Broadcaster) (*API, error) {
-	r := gin.Default()
+// New returns the API with its Router set up, or a nil API and the error if construction fails, never an API with
+// only part of its routes.
+func New(t *client.Twitch, u Users, b *slaytherelics.Broadcaster, opts Options) (*API, error) {
+	err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(opts.MiddlewareBeforeO11y...)
 	r.Use(o11y.Middleware)
+	r.Use(opts.MiddlewareAfterO11y...)
+	// Requests are already logged by o11y, gin's own logger is only wanted when debugging.
+	if opts.GinDebug {
+		r.Use(gin.Logger())
+	}
 
-	err := r.SetTrustedProxies(nil)
+	err = r.SetTrustedProxies(nil)
 	if err != nil {
 		return nil, err
 	}
@@ -36,13 +314,128 @@ func New(t *client.Twitch, u *slaytherelics.Users, b *slaytherelics.Broadcaster)
 		twitch:      t,
 		users:       u,
 		broadcaster: b,
-		deckLists:   make(map[string]string),
+		parser:      newParser(opts),
+		stats:       &serverStats{},
+		devMode:     opts.DevMode,
+		jsonp:       opts.JSONP,
+		deckLists:   make(map[string]*deckEntry),
+		decks:       make(map[[sha256.Size]byte]*deck),
+		shortHashes: make(map[string]*deck),
+		evicted:     make(map[string]time.Time),
+		deckTTL:     opts.DeckTTL,
+		maxDecks:    opts.MaxDecks,
 		deckLock:    &sync.RWMutex{},
+		streams:     newDeckHub(),
+		streamsByIP: make(map[string]int),
+		streamLock:  &sync.Mutex{},
+		metricNames: make(map[string]struct{}, len(opts.MetricNames)),
+		adminLogins: make(map[string]struct{}, len(opts.AdminLogins)),
+		uploads:     make(map[string]*chunkedUpload),
+		uploadTTL:   opts.UploadTTL,
+		uploadLock:  &sync.Mutex{},
+
+		staleWhileRevalidate: opts.StaleWhileRevalidate,
+		drainGracePeriod:     opts.DrainGracePeriod,
+		maxStreamsPerIP:      opts.MaxStreamsPerIP,
+
+		clock:    opts.clock,
+		etagHash: opts.ETagHash,
+	}
+	if api.clock == nil {
+		api.clock = realClock{}
+	}
+	api.translations, err = loadTranslations()
+	if err != nil {
+		return nil, err
+	}
+	api.parser.stats = api.stats
+	for _, name := range opts.MetricNames {
+		api.metricNames[strings.ToLower(name)] = struct{}{}
+	}
+	for _, login := range opts.AdminLogins {
+		api.adminLogins[strings.ToLower(login)] = struct{}{}
+	}
+	for _, pattern := range opts.AllowedNames {
+		api.allowedNames = append(api.allowedNames, strings.ToLower(pattern))
+	}
+	for _, pattern := range opts.DeniedNames {
+		api.deniedNames = append(api.deniedNames, strings.ToLower(pattern))
+	}
+	if api.uploadTTL <= 0 {
+		api.uploadTTL = defaultUploadTTL
+	}
+	api.batchTimeout = opts.BatchTimeout
+	if api.batchTimeout <= 0 {
+		api.batchTimeout = defaultBatchTimeout
+	}
+
+	api.missingDeckStatus = opts.MissingDeckStatus
+	if api.missingDeckStatus == 0 {
+		api.missingDeckStatus = 404
+	}
+	if opts.DefaultDeck != "" {
+		api.defaultDeck = &deckEntry{deck: newDeck(opts.DefaultDeck)}
+		if err := api.defaultDeck.deck.parse(api.parser); err != nil {
+			return nil, fmt.Errorf("invalid default deck: %w", err)
+		}
 	}
 
-	r.POST("/", api.postOldMessageHandler)
-	r.POST("/api/v1/auth", api.Auth)
-	r.POST("/api/v1/message", api.postMessageHandler)
-	r.GET("/deck/:name", api.getDeckHandler)
+	routes := r.Group(opts.BasePath)
+	// Middleware only applies to the routes registered after it, the health check is served while draining.
+	routes.GET("/healthz", o11y.NonPublic, api.getHealthHandler)
+	routes.Use(api.rejectWhileDraining)
+	routes.POST("/", api.postOldMessageHandler)
+	routes.POST("/api/v1/auth", api.Auth)
+	routes.POST("/api/v1/message", api.postMessageHandler)
+	// The routes without a name take it from the query, rather than redirecting.
+	for _, path := range []string{"/deck", "/deck/", "/deck/:name"} {
+		routes.GET(path, api.getDeckHandler)
+		routes.HEAD(path, discardBody, api.getDeckHandler)
+	}
+	routes.GET("/deck/:name/all", api.getAllDecksHandler)
+	routes.GET("/deck/:name/count", api.getDeckCountHandler)
+	routes.GET("/deck/:name/raw", api.getRawDeckHandler)
+	routes.GET("/deck/:name/dict", api.getDeckDictHandler)
+	routes.GET("/deck/:name/stream", api.limitStreams, api.getDeckStreamHandler)
+	routes.GET("/d/:hash", api.getDeckByHashHandler)
+	routes.POST("/decks/batch", api.postDecksBatchHandler)
+	routes.POST("/deck/validate", api.postDeckValidateHandler)
+	routes.POST("/deck/:name", api.postDeckHandler)
+	routes.POST("/deck/:name/chunk", api.postDeckChunkHandler)
+	routes.POST("/deck/:name/finalize", api.postDeckFinalizeHandler)
+	routes.GET("/version", o11y.NonPublic, api.getVersionHandler)
+	if opts.Admin {
+		admin := routes.Group("", o11y.NonPublic, api.requireAdmin)
+		admin.GET("/stats", api.getStatsHandler)
+		admin.DELETE("/decks", api.deleteDecksHandler)
+		admin.POST("/admin/deck/:name/evict", api.postEvictDeckHandler)
+	}
 	return api, nil
 }
+
+// deckParseError responds to a stored deck failing to parse, with a 413 for decks too large to render and a 500
+// otherwise.
+func (a *API) deckParseError(c *gin.Context, err error) {
+	if errors.Is(err, ErrRenderTooLarge) {
+		c.JSON(413, gin.H{"error": err.Error()})
+		return
+	}
+	a.internalError(c, "failed to parse deck", err)
+}
+
+// internalError responds with a 500. Outside of dev mode the error detail is only logged, with the request's trace ID
+// returned so it can be found.
+func (a *API) internalError(c *gin.Context, msg string, err error) {
+	ctx := c.Request.Context()
+	requestID := trace.SpanFromContext(ctx).SpanContext().TraceID().String()
+	o11y.Logger.ErrorCtx(ctx, msg, err,
+		slog.String("request_id", requestID),
+		slog.String("route", c.FullPath()),
+	)
+
+	if a.devMode {
+		c.JSON(500, gin.H{"error": err.Error(), "request_id": requestID})
+		return
+	}
+	c.JSON(500, gin.H{"error": msg, "request_id": requestID})
+}
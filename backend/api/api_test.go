@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gotest.tools/v3/assert"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+func TestMain(m *testing.M) {
+	// Gin's mode is global to the process, so it's set once here as main does, rather than by the tests.
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// TestParseWithoutMeter decodes decks before o11y is set up, as the parser alone does in benchmarks and fuzzing. It's
+// the first test so it runs before any other sets up o11y, and clears o11y.Meter in case it's run after one.
+func TestParseWithoutMeter(t *testing.T) {
+	defer func(m metric.Meter) { o11y.Meter = m }(o11y.Meter)
+	o11y.Meter = nil
+
+	p := newParser(Options{ExpectedMaxDeckSize: 1})
+	output, err := p.decompressDeck(smallDeck)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"card1": 3, "card2": 2, "card3": 1})
+
+	// The deck is oversized and has wildcards substituted, so parsing it records every parse metric.
+	body, err := newDeck(smallDeck).Bytes(p)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "card1 x3\ncard2 x2\ncard3 x1\n")
+}
+
+func TestOptionsValidate(t *testing.T) {
+	zero, one := 0, 1
+	testCases := []struct {
+		desc string
+		opts Options
+		err  string
+	}{
+		{
+			desc: "Duplicate separators",
+			opts: Options{Format: Format{CardSeparator: ";;;"}},
+			err:  `section and card separators are both ";;;"`,
+		},
+		{
+			desc: "Base path without leading slash",
+			opts: Options{BasePath: "slay"},
+			err:  `base path must start and not end with a slash, got "slay"`,
+		},
+		{
+			desc: "Base path with trailing slash",
+			opts: Options{BasePath: "/slay/"},
+			err:  `base path must start and not end with a slash, got "/slay/"`,
+		},
+		{
+			desc: "Negative max indices",
+			opts: Options{MaxIndices: -1},
+			err:  "max indices must not be negative, got -1",
+		},
+		{
+			desc: "Negative max streams per IP",
+			opts: Options{MaxStreamsPerIP: -1},
+			err:  "max streams per IP must not be negative, got -1",
+		},
+		{
+			desc: "Negative max dictionary entry length",
+			opts: Options{MaxDictEntryLength: -1},
+			err:  "max dictionary entry length must not be negative, got -1",
+		},
+		{
+			desc: "Negative max concurrent parses",
+			opts: Options{MaxConcurrentParses: -1},
+			err:  "max concurrent parses must not be negative, got -1",
+		},
+		{
+			desc: "Negative max unique cards",
+			opts: Options{MaxUniqueCards: -1},
+			err:  "max unique cards must not be negative, got -1",
+		},
+		{
+			desc: "Negative max rendered size",
+			opts: Options{MaxRenderedSize: -1},
+			err:  "max rendered size must not be negative, got -1",
+		},
+		{
+			desc: "Negative expected max deck size",
+			opts: Options{ExpectedMaxDeckSize: -1},
+			err:  "expected max deck size must not be negative, got -1",
+		},
+		{
+			desc: "Unknown invalid UTF-8 handling",
+			opts: Options{InvalidUTF8: InvalidUTF8Replace + 1},
+			err:  "unknown invalid UTF-8 handling 3",
+		},
+		{
+			desc: "Unknown ETag hash",
+			opts: Options{ETagHash: ETagHashSHA256 + 1},
+			err:  "unknown ETag hash 2",
+		},
+		{
+			desc: "Admin without admin logins",
+			opts: Options{Admin: true},
+			err:  "admin endpoints need at least one admin login",
+		},
+		{
+			desc: "Negative drain grace period",
+			opts: Options{DrainGracePeriod: -time.Second},
+			err:  "drain grace period must not be negative, got -1s",
+		},
+		{
+			desc: "Positive empty slot sentinel",
+			opts: Options{SkipEmptySlots: true, EmptySlotSentinel: &one},
+			err:  "empty slot sentinel must be negative, or 0 with an index base of 1, got 1",
+		},
+		{
+			desc: "Zero empty slot sentinel with 0-based indices",
+			opts: Options{SkipEmptySlots: true, EmptySlotSentinel: &zero},
+			err:  "empty slot sentinel must be negative, or 0 with an index base of 1, got 0",
+		},
+		{
+			desc: "Invalid deck name pattern",
+			opts: Options{DeniedNames: []string{"team_["}},
+			err:  `invalid deck name pattern "team_[": syntax error in pattern`,
+		},
+		{
+			desc: "Unsupported index base",
+			opts: Options{IndexBase: 2},
+			err:  "index base must be 0 or 1, got 2",
+		},
+		{
+			desc: "Negative deck TTL",
+			opts: Options{DeckTTL: -time.Second},
+			err:  "deck TTL must not be negative, got -1s",
+		},
+		{
+			desc: "Negative max decks",
+			opts: Options{MaxDecks: -1},
+			err:  "max decks must not be negative, got -1",
+		},
+		{
+			desc: "Negative upload TTL",
+			opts: Options{UploadTTL: -time.Minute},
+			err:  "upload TTL must not be negative, got -1m0s",
+		},
+		{
+			desc: "Unsupported missing deck status",
+			opts: Options{MissingDeckStatus: 500},
+			err:  "unsupported missing deck status 500",
+		},
+	}
+
+	assert.NilError(t, Options{}.validate())
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Error(t, tc.opts.validate(), tc.err)
+			a, err := New(nil, usersStub{}, nil, tc.opts)
+			assert.Error(t, err, tc.err)
+			assert.Assert(t, a == nil)
+		})
+	}
+}
+
+func TestNewGinLogging(t *testing.T) {
+	defer func(w io.Writer) { gin.DefaultWriter = w }(gin.DefaultWriter)
+
+	for _, debug := range []bool{false, true} {
+		logs := &bytes.Buffer{}
+		gin.DefaultWriter = logs
+
+		a := newTestAPI(t, Options{GinDebug: debug})
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+		assert.Equal(t, w.Code, 200)
+
+		if debug {
+			assert.Assert(t, strings.Contains(logs.String(), "/version"), logs.String())
+		} else {
+			assert.Equal(t, logs.String(), "")
+		}
+	}
+}
+
+func TestNewBasePath(t *testing.T) {
+	a := newTestAPI(t, Options{BasePath: "/slay"})
+	reader := newTestMeter(t)
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slay/deck/streamer", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 404)
+
+	// Requests are counted by route template, base path included, with every unmatched path sharing a label.
+	assert.Equal(t, counterValue(t, reader, "http.requests", attribute.String("target", "/slay/deck/:name")), int64(1))
+	assert.Equal(t, counterValue(t, reader, "http.requests", attribute.String("target", "unmatched")), int64(1))
+	assert.Equal(t, counterValue(t, reader, "http.requests", attribute.String("target", "/slay/deck/streamer")), int64(0))
+}
+
+func TestNewMiddlewareOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			calls = append(calls, name)
+			if c.Query("abort") == name {
+				c.AbortWithStatus(403)
+			}
+		}
+	}
+	a := newTestAPI(t, Options{
+		MiddlewareBeforeO11y: []gin.HandlerFunc{record("before1"), record("before2")},
+		MiddlewareAfterO11y:  []gin.HandlerFunc{record("after")},
+	})
+	reader := newTestMeter(t)
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.DeepEqual(t, calls, []string{"before1", "before2", "after"})
+
+	// Only the requests that reach the o11y middleware are counted.
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version?abort=before2", nil))
+	assert.Equal(t, w.Code, 403)
+	assert.Equal(t, counterValue(t, reader, "http.requests"), int64(1))
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version?abort=after", nil))
+	assert.Equal(t, w.Code, 403)
+	assert.Equal(t, counterValue(t, reader, "http.requests"), int64(2))
+}
@@ -0,0 +1,15 @@
+package api
+
+import "time"
+
+// clock tells the time to the deck and upload expiry, so tests can control it instead of sleeping.
+type clock interface {
+	Now() time.Time
+}
+
+// realClock is the clock of the system.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
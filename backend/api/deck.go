@@ -1,150 +1,1216 @@
 package api
 
 import (
-	"encoding/json"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/exp/slices"
+	"golang.org/x/sync/singleflight"
 )
 
 const WILDCARDS = "0123456789abcdefghijklmnopqrstvwxyzABCDEFGHIJKLMNOPQRSTVWXYZ_`[]/^%?@><=-+*:;,.()#$!'{}~"
 
-func (a *API) getDeckHandler(c *gin.Context) {
+// maxDecompressedSize bounds the expanded deck so nested dictionary entries can't be used as a decompression bomb.
+const maxDecompressedSize = 1 << 20
+
+// deckNamePattern matches the Twitch logins decks are stored under.
+var deckNamePattern = regexp.MustCompile(`^\w+$`)
+
+// deckName returns the name of the requested deck, taken from a "name" query parameter when the path has no valid
+// name, for overlay frameworks that mangle special characters in paths.
+func deckName(c *gin.Context) string {
 	name := c.Param("name")
-	name = strings.ToLower(name)
+	if !deckNamePattern.MatchString(name) {
+		if query := c.Query("name"); query != "" {
+			return strings.TrimSpace(query)
+		}
+	}
+	return name
+}
 
-	deck, ok := func() (string, bool) {
-		a.deckLock.RLock()
-		defer a.deckLock.RUnlock()
-		deck, ok := a.deckLists[name]
-		return deck, ok
-	}()
+func (a *API) getDeckHandler(c *gin.Context) {
+	name := deckName(c)
+	if strings.TrimSpace(name) == "" {
+		c.JSON(400, gin.H{"error": "deck name required"})
+		return
+	}
+	name = deckKey(name, c.Query("slot"))
 
+	e, isDefault, ok := a.servedEntry(name)
 	if !ok {
-		c.JSON(404, gin.H{"error": "deck not found"})
+		a.deckNotFound(c, name)
+		return
+	}
+	if isDefault {
+		// The placeholder is replaced as soon as a deck is uploaded, so it's never cached.
+		c.Header("Cache-Control", "no-store")
+	}
+	deck := e.deck
+	if !a.awaitParse(c, deck) {
+		return
+	}
+	c.Header(deckGenerationHeader, strconv.FormatUint(e.generation, 10))
+	c.Header(deckHashHeader, deck.shortHash())
+
+	var translation map[string]string
+	if lang := c.Query("lang"); lang != "" {
+		var ok bool
+		if translation, ok = a.translations[strings.ToLower(lang)]; !ok {
+			c.JSON(400, gin.H{"error": "unknown language"})
+			return
+		}
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		// Only the formats without a query parameter are negotiated.
+		c.Writer.Header().Add("Vary", "Accept")
+		if c.NegotiateFormat("text/plain", msgpackContentType) == msgpackContentType {
+			format = "msgpack"
+		}
+	}
+	switch format {
+	case "":
+	case "json":
+		a.writeDeckJSON(c, e, translation)
+		return
+	case "msgpack":
+		var body []byte
+		var cache *encodingCache
+		var err error
+		if translation != nil {
+			body, err = deck.encodeMsgPack(a.parser, translation)
+		} else {
+			body, err = deck.MsgPack(a.parser)
+			cache = &deck.msgpackEncodings
+		}
+		if err != nil {
+			a.deckParseError(c, err)
+			return
+		}
+		c.Header(deckFormatHeader, strconv.Itoa(deck.format))
+		a.writeDeck(c, msgpackContentType, body, cache)
+		return
+	default:
+		c.JSON(400, gin.H{"error": "unknown format"})
 		return
 	}
-	d, err := decompressDeck(deck)
+
+	var exclude []string
+	if excluded := c.Query("exclude"); excluded != "" {
+		exclude = strings.Split(excluded, ",")
+	}
+
+	group := c.Query("group")
+	if len(exclude) == 0 && group == "" && translation == nil {
+		c.Writer.Header().Add("Vary", deckBaseGenerationHeader)
+		if a.writeDeckDelta(c, e) {
+			return
+		}
+	}
+
+	renderer := a.parser.withPins(deck.pins)
+	if translation != nil {
+		renderer = renderer.translated(translation)
+	}
+	var body []byte
+	var cache *encodingCache
+	var err error
+	switch {
+	case group == "type":
+		var d map[string]map[string]int
+		d, err = deck.CountsByType(a.parser, exclude)
+		total, unique := 0, 0
+		for typ, counts := range d {
+			if translation != nil {
+				counts = translateCounts(counts, translation)
+				d[typ] = counts
+			}
+			total += countTotal(counts)
+			unique += len(counts)
+		}
+		body = a.parser.frameDeck(renderer.renderDeckGrouped(d), total, unique)
+	case group != "":
+		c.JSON(400, gin.H{"error": "unknown group"})
+		return
+	case len(exclude) > 0 || translation != nil:
+		var d map[string]int
+		d, err = deck.Counts(a.parser, exclude)
+		if translation != nil {
+			d = translateCounts(d, translation)
+		}
+		body = a.parser.frameDeck(renderer.renderDeck(d), countTotal(d), len(d))
+	default:
+		body, err = deck.Bytes(a.parser)
+		cache = &deck.encodings
+	}
+	if err == nil && cache == nil {
+		// Translated names and grouped lines can render larger than the deck did when stored.
+		err = a.parser.checkRenderedSize(len(body))
+	}
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		a.deckParseError(c, err)
 		return
 	}
 
-	keys := make([]string, 0, len(d))
-	for k := range d {
-		keys = append(keys, k)
+	c.Header(deckFormatHeader, strconv.Itoa(deck.format))
+	a.writeDeck(c, "text/plain", body, cache)
+}
+
+// getAllDecksHandler serves the combined card counts of every slot stored for a name, for mods playing several
+// characters at once.
+func (a *API) getAllDecksHandler(c *gin.Context) {
+	name := strings.ToLower(c.Param("name"))
+
+	decks := a.getSlotDecks(name)
+	if len(decks) == 0 {
+		a.deckNotFound(c, name)
+		return
 	}
 
-	slices.SortFunc(keys, func(i, j string) bool {
-		if i == "Ascender's Bane" {
-			return false
+	var exclude []string
+	if e := c.Query("exclude"); e != "" {
+		exclude = strings.Split(e, ",")
+	}
+
+	combined := make(map[string]int)
+	for _, deck := range decks {
+		if !a.awaitParse(c, deck) {
+			return
 		}
-		if j == "Ascender's Bane" {
-			return true
+		counts, err := deck.Counts(a.parser, exclude)
+		if err != nil {
+			a.deckParseError(c, err)
+			return
 		}
-		return i < j
-	})
+		for card, count := range counts {
+			combined[card] += count
+		}
+	}
+
+	body := a.parser.frameDeck(a.parser.renderDeck(combined), countTotal(combined), len(combined))
+	if err := a.parser.checkRenderedSize(len(body)); err != nil {
+		a.deckParseError(c, err)
+		return
+	}
+	a.writeDeck(c, "text/plain", body, nil)
+}
+
+// jsonpCallbackPattern matches the callback names accepted for JSONP responses.
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z_$][\w$]*$`)
+
+// deckResult is the JSON form of a deck, its cards along with the totals served by the count endpoint.
+type deckResult struct {
+	Cards      any    `json:"cards"`
+	Total      int    `json:"total"`
+	Unique     int    `json:"unique"`
+	Generation uint64 `json:"generation"`
+}
+
+// msgpackContentType is the media type of MsgPack deck responses.
+const msgpackContentType = "application/msgpack"
+
+// writeDeckJSON responds with the card details of deck as a deckResult, or as the bare array of card details given
+// shape=array. It's JSONP given a "callback" query parameter when enabled. A "fields" query parameter selects the
+// card fields to emit, such as "name,type" to leave out the descriptions. The card names are translated with
+// translation when it isn't nil.
+func (a *API) writeDeckJSON(c *gin.Context, e *deckEntry, translation map[string]string) {
+	deck := e.deck
+	shape := c.Query("shape")
+	if shape != "" && shape != "object" && shape != "array" {
+		c.JSON(400, gin.H{"error": "unknown shape"})
+		return
+	}
+
+	var positions []int
+	if fields := c.Query("fields"); fields != "" {
+		var err error
+		positions, err = detailFieldPositions(strings.Split(fields, ","))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	details, err := deck.Details(a.parser)
+	if err != nil {
+		a.deckParseError(c, err)
+		return
+	}
+	if translation != nil {
+		translateDetails(details, translation)
+	}
+	var cards any = details
+	if positions != nil {
+		cards = selectDetailFields(details, positions)
+	}
+	body := cards
+	if shape != "array" {
+		total, unique, err := deck.Summary(a.parser)
+		if err != nil {
+			a.deckParseError(c, err)
+			return
+		}
+		body = deckResult{Cards: cards, Total: total, Unique: unique, Generation: e.generation}
+	}
+
+	c.Header(deckFormatHeader, strconv.Itoa(deck.format))
+	callback := c.Query("callback")
+	if !a.jsonp || callback == "" {
+		c.JSON(200, body)
+		return
+	}
+	if !jsonpCallbackPattern.MatchString(callback) {
+		c.JSON(400, gin.H{"error": "invalid callback"})
+		return
+	}
+	c.JSONP(200, body)
+}
+
+// getDeckByHashHandler serves the rendered deck whose short hash is in the path, for shareable links.
+func (a *API) getDeckByHashHandler(c *gin.Context) {
+	hash := c.Param("hash")
+
+	deck, ok := a.getDeckByHash(hash)
+	if !ok {
+		a.deckNotFound(c, hash)
+		return
+	}
+	if !a.awaitParse(c, deck) {
+		return
+	}
+
+	body, err := deck.Bytes(a.parser)
+	if err != nil {
+		a.deckParseError(c, err)
+		return
+	}
+	c.Header(deckFormatHeader, strconv.Itoa(deck.format))
+	a.writeDeck(c, "text/plain", body, &deck.encodings)
+}
+
+// getRawDeckHandler serves the compressed deck exactly as it was stored, for mirrors.
+func (a *API) getRawDeckHandler(c *gin.Context) {
+	name := deckKey(c.Param("name"), c.Query("slot"))
+
+	deck, ok := a.getDeck(name)
+	if !ok {
+		a.deckNotFound(c, name)
+		return
+	}
+
+	c.Header(deckFormatHeader, strconv.Itoa(deck.format))
+	c.Data(200, "text/plain", []byte(deck.raw))
+}
+
+// getDeckDictHandler serves the compression dictionary of a deck as a JSON array, without expanding its body, for
+// debugging and analytics.
+func (a *API) getDeckDictHandler(c *gin.Context) {
+	name := deckKey(c.Param("name"), c.Query("slot"))
+
+	deck, ok := a.getDeck(name)
+	if !ok {
+		a.deckNotFound(c, name)
+		return
+	}
+
+	c.Header(deckFormatHeader, strconv.Itoa(deck.format))
+	c.JSON(200, a.parser.dictionary(deck.raw))
+}
+
+// getDeckCountHandler serves the number of cards of a deck and of distinct cards, as JSON or as the plain number of
+// cards given format=text.
+func (a *API) getDeckCountHandler(c *gin.Context) {
+	name := deckKey(c.Param("name"), c.Query("slot"))
+
+	deck, ok := a.getDeck(name)
+	if !ok {
+		a.deckNotFound(c, name)
+		return
+	}
+	if !a.awaitParse(c, deck) {
+		return
+	}
+
+	total, unique, err := deck.Summary(a.parser)
+	if err != nil {
+		a.deckParseError(c, err)
+		return
+	}
 
+	switch c.Query("format") {
+	case "":
+		c.JSON(200, gin.H{"total": total, "unique": unique})
+	case "text":
+		c.Data(200, "text/plain", []byte(strconv.Itoa(total)))
+	default:
+		c.JSON(400, gin.H{"error": "unknown format"})
+	}
+}
+
+// writeDeck responds with the deck body of contentType, or a 304 if the client already has it. The body is compressed
+// with the most preferred encoding the client accepts, taken from cache if set so it's only compressed once.
+func (a *API) writeDeck(c *gin.Context, contentType string, body []byte, cache *encodingCache) {
+	encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+	etag := deckETag(body, a.etagHash)
+	if encoding != encodingIdentity {
+		// Every encoding is a different representation, which can't share a strong ETag.
+		etag = strings.TrimSuffix(etag, `"`) + "-" + preferredEncodings[encoding] + `"`
+	}
+	c.Header("ETag", etag)
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(304)
+		return
+	}
+
+	if encoding != encodingIdentity {
+		if cache != nil {
+			body = cache.encoded(encoding, body)
+		} else {
+			body = encodeBody(encoding, body, false)
+		}
+		c.Header("Content-Encoding", preferredEncodings[encoding])
+	}
+	c.Data(200, contentType, body)
+}
+
+// renderDeck formats the card counts as one "name xcount" line per card.
+func (p parser) renderDeck(d map[string]int) []byte {
 	result := strings.Builder{}
-	for _, k := range keys {
+	for _, k := range p.sortedCardNames(d) {
 		result.WriteString(k)
 		result.WriteString(" x")
 		result.WriteString(fmt.Sprint(d[k]))
 		result.WriteString("\n")
 	}
+	return []byte(result.String())
+}
+
+// renderedSize returns the size of the card list rendered by renderDeck, without rendering it.
+func renderedSize(d map[string]int) int {
+	size := 0
+	for k, count := range d {
+		size += len(k) + len(" x") + len(strconv.Itoa(count)) + len("\n")
+	}
+	return size
+}
+
+// framedSize returns the size of the deck frameDeck writes around a card list body of bodySize bytes, without framing
+// it.
+func (p parser) framedSize(bodySize, total, unique int) int {
+	if p.header == "" && p.footer == "" {
+		return bodySize
+	}
+	r := strings.NewReplacer("{total}", strconv.Itoa(total), "{unique}", strconv.Itoa(unique))
+	size := bodySize
+	if p.header != "" {
+		size += len(r.Replace(p.header)) + len("\n")
+	}
+	if p.footer != "" {
+		size += len(r.Replace(p.footer)) + len("\n")
+	}
+	return size
+}
+
+// checkRenderedSize returns an error wrapping ErrRenderTooLarge if a rendered deck of size bytes is above the
+// maxRenderedSize.
+func (p parser) checkRenderedSize(size int) error {
+	if p.maxRenderedSize > 0 && size > p.maxRenderedSize {
+		return fmt.Errorf("%w: %d bytes, above the %d bytes limit", ErrRenderTooLarge, size, p.maxRenderedSize)
+	}
+	return nil
+}
+
+// frameDeck writes the header and footer lines around the rendered card list body, listing total cards of which unique
+// are distinct. The body is returned as is without either.
+func (p parser) frameDeck(body []byte, total, unique int) []byte {
+	if p.header == "" && p.footer == "" {
+		return body
+	}
+	r := strings.NewReplacer("{total}", strconv.Itoa(total), "{unique}", strconv.Itoa(unique))
+	result := bytes.Buffer{}
+	if p.header != "" {
+		result.WriteString(r.Replace(p.header))
+		result.WriteString("\n")
+	}
+	result.Write(body)
+	if p.footer != "" {
+		result.WriteString(r.Replace(p.footer))
+		result.WriteString("\n")
+	}
+	return result.Bytes()
+}
+
+// countTotal returns the number of cards counted in d.
+func countTotal(d map[string]int) int {
+	total := 0
+	for _, count := range d {
+		total += count
+	}
+	return total
+}
+
+// renderDeckGrouped formats the card counts of each card type as one "[type] name xcount, name xcount" line per type,
+// the types in alphabetical order.
+func (p parser) renderDeckGrouped(d map[string]map[string]int) []byte {
+	types := make([]string, 0, len(d))
+	for typ := range d {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+
+	result := strings.Builder{}
+	for _, typ := range types {
+		result.WriteString("[")
+		result.WriteString(typ)
+		result.WriteString("] ")
+		for i, k := range p.sortedCardNames(d[typ]) {
+			if i > 0 {
+				result.WriteString(", ")
+			}
+			result.WriteString(k)
+			result.WriteString(" x")
+			result.WriteString(fmt.Sprint(d[typ][k]))
+		}
+		result.WriteString("\n")
+	}
+	return []byte(result.String())
+}
+
+// DefaultPinnedCards are the cards listed after every other card unless NoDefaultPins is set: Ascender's Bane, the
+// curse of Slay the Spire's ascension mode.
+var DefaultPinnedCards = []string{"Ascender's Bane"}
+
+// withPins returns p listing the cards pins after the others instead of its pinned cards, or p itself if pins is
+// empty.
+func (p parser) withPins(pins []string) parser {
+	if len(pins) == 0 {
+		return p
+	}
+	p.pins = make(map[string]int, len(pins))
+	for i, card := range pins {
+		if _, ok := p.pins[card]; !ok {
+			p.pins[card] = i
+		}
+	}
+	return p
+}
+
+// sortedCardNames returns the card names of d in display order: alphabetical, followed by the pinned cards.
+func (p parser) sortedCardNames(d map[string]int) []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+
+	// Keys come from map iteration, so the comparator must be a total order for the output (and its ETag)
+	// to be deterministic.
+	slices.SortStableFunc(keys, func(i, j string) bool {
+		pinI, pinnedI := p.pins[i]
+		pinJ, pinnedJ := p.pins[j]
+		if pinnedI || pinnedJ {
+			return pinnedJ && (!pinnedI || pinI < pinJ)
+		}
+		return i < j
+	})
+	return keys
+}
+
+// ETagHash selects the hash of the body the ETags of rendered decks are made of.
+type ETagHash int
+
+const (
+	// ETagHashFNV hashes with 64-bit FNV-1a, fast but not collision resistant.
+	ETagHashFNV ETagHash = iota
+	// ETagHashSHA256 hashes with SHA-256.
+	ETagHashSHA256
+)
+
+// deckETag returns the strong ETag of the rendered deck body, hashed with hash.
+func deckETag(body []byte, hash ETagHash) string {
+	if hash == ETagHashSHA256 {
+		return fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(body)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// discardBody makes the rest of the handler chain write headers only, for serving HEAD requests.
+func discardBody(c *gin.Context) {
+	c.Writer = headResponseWriter{c.Writer}
+}
+
+type headResponseWriter struct {
+	gin.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeaderNow()
+	return len(b), nil
+}
+
+func (w headResponseWriter) WriteString(s string) (int, error) {
+	w.WriteHeaderNow()
+	return len(s), nil
+}
+
+// defaultMaxIndices is the default limit on the number of card indices in a deck.
+const defaultMaxIndices = 2000
+
+// defaultMaxDictEntryLength is the default limit on the length of a compression dictionary entry.
+const defaultMaxDictEntryLength = 4 << 10
+
+// defaultMaxUniqueCards is the default limit on the number of distinct cards of a deck.
+const defaultMaxUniqueCards = 500
+
+// defaultExpectedMaxDeckSize is the default number of cards above which a deck is reported as oversized.
+const defaultExpectedMaxDeckSize = 1000
+
+// parser decodes compressed decks according to the API Options.
+type parser struct {
+	Format
+
+	maxIndices int
+	strict     bool
+	stripCR    bool
+	nameCasing NameCasing
+	cardNames  map[string]string
+	// invalidUTF8 selects how card names that aren't valid UTF-8 are handled.
+	invalidUTF8 InvalidUTF8
+	// pins maps the cards listed after every other card to their position among them.
+	pins map[string]int
+	// maxDictEntryLength limits the length of every compression dictionary entry.
+	maxDictEntryLength int
+	// maxUniqueCards limits the number of distinct cards of a deck.
+	maxUniqueCards int
+	// rejectMissingWildcards fails decks referencing entries past the end of their dictionary.
+	rejectMissingWildcards bool
+	// maxRenderedSize bounds the size of the rendered deck, unless it's zero.
+	maxRenderedSize int
+	// expectedMaxDeckSize is the number of cards above which a deck is reported as oversized.
+	expectedMaxDeckSize int
+	// parseSlots bounds the number of concurrent cold parses of parseContext, if set.
+	parseSlots chan struct{}
+	// stats counts the parses, if set.
+	stats *serverStats
+	// emptySlot is the index of empty deck slots to skip, if skipEmptySlots.
+	skipEmptySlots bool
+	emptySlot      int
+	// indexBase is subtracted from every card index.
+	indexBase int
+	// uniqueIndices drops the repeats of a card index.
+	uniqueIndices bool
+	// header and footer are the templates of the lines framing plain text decks.
+	header string
+	footer string
+	// flights shares the concurrent parses of decks with the same hash.
+	flights *singleflight.Group
+}
+
+func newParser(opts Options) parser {
+	p := parser{
+		Format:     opts.Format.withDefaults(),
+		maxIndices: opts.MaxIndices,
+		strict:     opts.Strict,
+		stripCR:    opts.StripCR,
+		nameCasing: opts.NameCasing,
+		cardNames:  opts.CardNames,
+
+		invalidUTF8: opts.InvalidUTF8,
 
-	c.Data(200, "text/plain", []byte(result.String()))
+		maxDictEntryLength:     opts.MaxDictEntryLength,
+		maxUniqueCards:         opts.MaxUniqueCards,
+		rejectMissingWildcards: opts.RejectMissingWildcards,
+		expectedMaxDeckSize:    opts.ExpectedMaxDeckSize,
+		maxRenderedSize:        opts.MaxRenderedSize,
+
+		skipEmptySlots: opts.SkipEmptySlots,
+		emptySlot:      -1,
+		indexBase:      opts.IndexBase,
+
+		uniqueIndices: opts.UniqueIndices,
+
+		header: opts.Header,
+		footer: opts.Footer,
+
+		flights: &singleflight.Group{},
+	}
+	if p.maxIndices <= 0 {
+		p.maxIndices = defaultMaxIndices
+	}
+	var pinned []string
+	if !opts.NoDefaultPins {
+		pinned = append(pinned, DefaultPinnedCards...)
+	}
+	pinned = append(pinned, opts.PinnedCards...)
+	p = p.withPins(pinned)
+	if p.maxDictEntryLength <= 0 {
+		p.maxDictEntryLength = defaultMaxDictEntryLength
+	}
+	if p.maxUniqueCards <= 0 {
+		p.maxUniqueCards = defaultMaxUniqueCards
+	}
+	if p.expectedMaxDeckSize <= 0 {
+		p.expectedMaxDeckSize = defaultExpectedMaxDeckSize
+	}
+	maxParses := opts.MaxConcurrentParses
+	if maxParses <= 0 {
+		maxParses = runtime.GOMAXPROCS(0)
+	}
+	p.parseSlots = make(chan struct{}, maxParses)
+	if opts.EmptySlotSentinel != nil {
+		p.emptySlot = *opts.EmptySlotSentinel
+	}
+	return p
 }
 
-func escapeRegexp(s string) string {
-	r := regexp.MustCompile(`[-\/\\^$*+?.()|[\]{}]`)
-	return r.ReplaceAllString(s, "\\$&")
+func (p parser) decompress(s string) (string, error) {
+	text, err := p.decompressBytes([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// decompressBytes expands the compressed body of b with its dictionary, once carriage returns are removed if stripCR.
+// The dictionary entries alias b, so it must not be modified while expanding.
+func (p parser) decompressBytes(b []byte) ([]byte, error) {
+	text, _, err := p.expand(b)
+	return text, err
 }
 
-func decompress(s string) (string, error) {
-	parts := strings.Split(s, "||")
+// expand is decompressBytes, also returning the number of wildcards substituted.
+func (p parser) expand(b []byte) ([]byte, int, error) {
+	b = p.withoutCR(b)
+	parts := bytes.Split(b, []byte(p.DictSeparator))
 	if len(parts) < 2 {
-		return "", errors.New("invalid deck")
+		return nil, 0, errors.New("invalid deck")
 	}
 
-	compressionDict := strings.Split(parts[0], "|")
-	text := parts[1]
+	dict := bytes.Split(parts[0], []byte(p.WordSeparator))
+	if len(dict) > len(WILDCARDS) {
+		return nil, 0, errors.New("compression dictionary too large")
+	}
+	for i, entry := range dict {
+		if len(entry) > p.maxDictEntryLength {
+			return nil, 0, fmt.Errorf("compression dictionary entry %d is longer than %d bytes", i,
+				p.maxDictEntryLength)
+		}
+	}
+	// No cards can exist without a body, whatever the dictionary.
+	if p.strict && len(parts[1]) == 0 {
+		return nil, 0, errors.New("deck is empty")
+	}
 
-	for i := len(compressionDict) - 1; i >= 0; i-- {
-		word := compressionDict[i]
-		wildCard := fmt.Sprintf("&%c", WILDCARDS[i])
-		r, err := regexp.Compile(escapeRegexp(wildCard))
-		if err != nil {
-			return "", err
+	e := newExpander(dict)
+	text, err := e.expandParallel(parts[1], runtime.GOMAXPROCS(0))
+	if err != nil {
+		return nil, 0, err
+	}
+	recordCompressionRatio(len(text), len(b))
+	recordSubstitutions(e.substitutions)
+	if p.rejectMissingWildcards {
+		if wildcard, ok := missingWildcard(text, len(dict)); ok {
+			return nil, 0, fmt.Errorf("body references missing dictionary entry &%c", wildcard)
 		}
-		text = r.ReplaceAllString(text, word)
 	}
-	return text, nil
+	// An empty dictionary section still splits into a single empty entry, which isn't expected to be used.
+	if p.strict && len(parts[0]) > 0 {
+		if i := e.unused(); i >= 0 {
+			return nil, 0, fmt.Errorf("compression dictionary entry %d is never used", i)
+		}
+	}
+	return text, e.substitutions, nil
 }
 
-func parseCommaDelimitedIntegerArray(s string) ([]int, error) {
-	if s == "-" {
+// withoutCR returns b without its carriage returns if stripCR, b itself otherwise.
+func (p parser) withoutCR(b []byte) []byte {
+	if p.stripCR && bytes.IndexByte(b, '\r') >= 0 {
+		return bytes.ReplaceAll(b, []byte("\r"), nil)
+	}
+	return b
+}
+
+// dictionary returns the compression dictionary entries of a compressed deck, as decoding sees them.
+func (p parser) dictionary(deck string) []string {
+	if p.stripCR {
+		deck = string(p.withoutCR([]byte(deck)))
+	}
+	dict, _, ok := strings.Cut(deck, p.DictSeparator)
+	if !ok || dict == "" {
+		return []string{}
+	}
+	return strings.Split(dict, p.WordSeparator)
+}
+
+// missingWildcard returns the first wildcard of text referencing an entry past the end of a dictionary of size
+// entries.
+func missingWildcard(text []byte, size int) (byte, bool) {
+	for {
+		i := bytes.IndexByte(text, '&')
+		if i < 0 || i == len(text)-1 {
+			return 0, false
+		}
+		if strings.IndexByte(WILDCARDS, text[i+1]) >= size {
+			return text[i+1], true
+		}
+		text = text[i+1:]
+	}
+}
+
+// parseCommaDelimitedIntegerArray parses the deck indices, failing as soon as more than maxIndices are scanned.
+func (p parser) parseCommaDelimitedIntegerArray(s string) ([]int, error) {
+	if s == "-" || strings.TrimSpace(s) == "" {
 		return make([]int, 0), nil
 	}
-	//nolint:prealloc
-	var result []int
-	err := json.Unmarshal([]byte(fmt.Sprintf("[%s]", s)), &result)
-	return result, err
+
+	size := strings.Count(s, ",") + 1
+	if size > p.maxIndices {
+		size = p.maxIndices
+	}
+	result := make([]int, 0, size)
+	var err error
+	forEachDelimited(s, ",", func(token string) bool {
+		if len(result) == p.maxIndices {
+			err = fmt.Errorf("deck has more than %d card indices", p.maxIndices)
+			return false
+		}
+		var idx int
+		idx, err = strconv.Atoi(strings.TrimSpace(token))
+		if err != nil {
+			return false
+		}
+		result = append(result, idx)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func splitSemicolonDelimited2DArray(s string) [][]string {
+// forEachDelimited calls fn with every token of s separated by sep in order, stopping early once fn returns false. It
+// returns the number of tokens fn was called with, the token it stopped at included.
+func forEachDelimited(s, sep string, fn func(token string) bool) int {
+	count := 0
+	for {
+		token, rest, found := strings.Cut(s, sep)
+		count++
+		if !fn(token) || !found {
+			return count
+		}
+		s = rest
+	}
+}
+
+func (p parser) splitSemicolonDelimited2DArray(s string) [][]string {
 	if s == "-" {
 		return make([][]string, 0)
 	}
 
 	//nolint:prealloc
 	var result [][]string
-	split := strings.Split(s, ";;")
+	split := strings.Split(s, p.CardSeparator)
 	for _, element := range split {
-		result = append(result, strings.Split(element, ";"))
+		result = append(result, strings.Split(element, p.FieldSeparator))
 	}
 	return result
 }
 
-func parseCards(cards [][]string) []string {
+func (p parser) parseCards(cards [][]string) []string {
 	//nolint:prealloc
 	var result []string
 	for _, card := range cards {
-		result = append(result, parseCard(card))
+		result = append(result, p.parseCard(card))
 	}
 	return result
 }
 
-func parseCard(c []string) string {
+// parseCard returns the name of card, remapped if the remap table has an entry for it.
+func (p parser) parseCard(c []string) string {
+	if name, ok := p.cardNames[c[0]]; ok {
+		return name
+	}
 	return c[0]
 }
 
-func decompressDeck(deck string) (map[string]int, error) {
-	deck, err := decompress(deck)
+// ErrTruncatedDeck is returned for decks that look cut off mid-transfer, which are worth uploading again.
+var ErrTruncatedDeck = errors.New("deck is truncated")
+
+// splitDeck decompresses deck into its card indices and card list, checking every index references a card. The indices
+// are returned 0-based whatever the indexBase, and empty slots are left out of them when skipped, as are repeated
+// indices when uniqueIndices.
+func (p parser) splitDeck(deck string) ([]int, [][]string, error) {
+	indices, cards, _, err := p.splitDeckCounted(deck)
+	return indices, cards, err
+}
+
+// splitDeckCounted is splitDeck, also returning the number of wildcards substituted while decompressing.
+func (p parser) splitDeckCounted(deck string) ([]int, [][]string, int, error) {
+	text, substitutions, err := p.expand([]byte(deck))
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	deck = string(text)
+
+	parts := strings.Split(deck, p.SectionSeparator)
+	if len(parts) < 2 {
+		// A card list separated from the indices with the card separator instead would otherwise be reported as
+		// missing, when the mod most likely wrote the wrong separator.
+		if strings.Contains(deck, p.CardSeparator) {
+			return nil, nil, 0, fmt.Errorf("deck has no card definitions: no %q section separator but found %q, "+
+				"likely the wrong separator", p.SectionSeparator, p.CardSeparator)
+		}
+		return nil, nil, 0, errors.New("deck has no card definitions")
+	}
+	if strings.HasSuffix(parts[0], ",") {
+		return nil, nil, 0, fmt.Errorf("%w: card indices end with a separator", ErrTruncatedDeck)
+	}
+	d, err := p.parseCommaDelimitedIntegerArray(parts[0])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	cards := p.splitSemicolonDelimited2DArray(parts[1])
+	if len(d) > 0 && (parts[1] == "" || parts[1] == "-") {
+		return nil, nil, 0, errors.New("deck references cards but card list is empty")
+	}
+	if strings.HasSuffix(parts[1], p.CardSeparator) {
+		return nil, nil, 0, fmt.Errorf("%w: card list ends with a separator", ErrTruncatedDeck)
 	}
+	if p.invalidUTF8 != InvalidUTF8Keep {
+		for i, card := range cards {
+			if utf8.ValidString(card[0]) {
+				continue
+			}
+			if p.invalidUTF8 == InvalidUTF8Reject {
+				return nil, nil, 0, fmt.Errorf("name of card %d is not valid UTF-8", i)
+			}
+			card[0] = strings.ToValidUTF8(card[0], string(utf8.RuneError))
+		}
+	}
+
+	filled := d[:0]
+	var seen map[int]bool
+	if p.uniqueIndices {
+		seen = make(map[int]bool, len(d))
+	}
+	for _, idx := range d {
+		if p.skipEmptySlots && idx == p.emptySlot {
+			continue
+		}
+		if seen != nil {
+			if seen[idx] {
+				continue
+			}
+			seen[idx] = true
+		}
+		idx -= p.indexBase
+		if idx >= len(cards) {
+			return nil, nil, 0, fmt.Errorf("%w: card index %d beyond the %d cards", ErrTruncatedDeck, idx+p.indexBase,
+				len(cards))
+		}
+		if idx < 0 {
+			return nil, nil, 0, errors.New("card index out of bounds")
+		}
+		filled = append(filled, idx)
+	}
+	return filled, cards, substitutions, nil
+}
 
-	parts := strings.Split(deck, ";;;")
-	d, err := parseCommaDelimitedIntegerArray(parts[0])
+func (p parser) decompressDeck(deck string) (map[string]int, error) {
+	d, cards, err := p.splitDeck(deck)
 	if err != nil {
 		return nil, err
 	}
-	cards := parseCards(splitSemicolonDelimited2DArray(parts[1]))
+	return p.countCards(d, cards, nil), nil
+}
+
+// countCards counts the cards referenced by the deck indices, skipping every card whose name or type (its third
+// field) case-insensitively matches one of exclude.
+func (p parser) countCards(d []int, cards [][]string, exclude []string) map[string]int {
+	counts, _ := p.countCardsLimited(d, cards, exclude, 0)
+	return counts
+}
+
+// ErrTooManyUniqueCards is returned for decks with more distinct cards than the MaxUniqueCards.
+var ErrTooManyUniqueCards = errors.New("deck has too many unique cards")
+
+// countCardsLimited is countCards, failing with ErrTooManyUniqueCards as soon as more than maxUnique distinct cards
+// are counted, unless maxUnique is zero.
+func (p parser) countCardsLimited(d []int, cards [][]string, exclude []string, maxUnique int) (map[string]int, error) {
+	names := p.parseCards(cards)
+	folder := newNameFolder(p.nameCasing)
 
 	deckDict := make(map[string]int)
 	for _, idx := range d {
-		if idx < 0 || idx >= len(cards) {
-			return nil, errors.New("card index out of bounds")
+		if len(exclude) > 0 && p.isExcluded(cards[idx], exclude) {
+			continue
+		}
+		name := folder.fold(names[idx])
+		if _, ok := deckDict[name]; !ok && maxUnique > 0 && len(deckDict) == maxUnique {
+			return nil, fmt.Errorf("%w: more than %d", ErrTooManyUniqueCards, maxUnique)
 		}
-
-		name := cards[idx]
 		deckDict[name]++
 	}
 
-	return deckDict, nil
+	return folder.resolve(deckDict), nil
+}
+
+// untypedCard is the type cards without a type field are grouped under.
+const untypedCard = "Other"
+
+// countCardsByType is countCards grouped by card type (the third field).
+func (p parser) countCardsByType(d []int, cards [][]string, exclude []string) map[string]map[string]int {
+	folder := newNameFolder(p.nameCasing)
+
+	deckDict := make(map[string]map[string]int)
+	for _, idx := range d {
+		card := cards[idx]
+		if len(exclude) > 0 && p.isExcluded(card, exclude) {
+			continue
+		}
+		typ := cardField(card, 2)
+		if typ == "" {
+			typ = untypedCard
+		}
+		if deckDict[typ] == nil {
+			deckDict[typ] = make(map[string]int)
+		}
+		deckDict[typ][folder.fold(p.parseCard(card))]++
+	}
+	for typ, counts := range deckDict {
+		deckDict[typ] = folder.resolve(counts)
+	}
+	return deckDict
+}
+
+// NameCasing selects how card names differing only by case are counted.
+type NameCasing int
+
+const (
+	// NameCasingExact counts card names differing by case as different cards.
+	NameCasingExact NameCasing = iota
+	// NameCasingFirstSeen counts them as one card displayed with the casing referenced first by the deck.
+	NameCasingFirstSeen
+	// NameCasingLastSeen counts them as one card displayed with the casing referenced last by the deck.
+	NameCasingLastSeen
+	// NameCasingSmallest counts them as one card displayed with the lexicographically smallest casing.
+	NameCasingSmallest
+)
+
+// InvalidUTF8 selects how card names that aren't valid UTF-8 are handled, such as names cut mid-character by a
+// truncated serialization.
+type InvalidUTF8 int
+
+const (
+	// InvalidUTF8Keep keeps card names as they are.
+	InvalidUTF8Keep InvalidUTF8 = iota
+	// InvalidUTF8Reject fails decks with card names that aren't valid UTF-8.
+	InvalidUTF8Reject
+	// InvalidUTF8Replace replaces every invalid sequence of card names with the Unicode replacement character.
+	InvalidUTF8Replace
+)
+
+// nameFolder merges the card names differing only by case, picking their display name according to its casing.
+type nameFolder struct {
+	casing NameCasing
+	// folded name -> display name
+	display map[string]string
+}
+
+func newNameFolder(casing NameCasing) nameFolder {
+	return nameFolder{casing: casing, display: make(map[string]string)}
+}
+
+// fold returns the key to count name under, noting its casing.
+func (f nameFolder) fold(name string) string {
+	if f.casing == NameCasingExact {
+		return name
+	}
+
+	key := strings.ToLower(name)
+	current, ok := f.display[key]
+	if !ok || f.casing == NameCasingLastSeen || (f.casing == NameCasingSmallest && name < current) {
+		f.display[key] = name
+	}
+	return key
+}
+
+// resolve replaces the folded keys of counts by their display names.
+func (f nameFolder) resolve(counts map[string]int) map[string]int {
+	if f.casing == NameCasingExact {
+		return counts
+	}
+	result := make(map[string]int, len(counts))
+	for key, count := range counts {
+		result[f.display[key]] = count
+	}
+	return result
+}
+
+// isExcluded reports whether the name of card, once remapped, or its type case-insensitively matches one of exclude.
+func (p parser) isExcluded(card []string, exclude []string) bool {
+	name := p.parseCard(card)
+	for _, e := range exclude {
+		if strings.EqualFold(name, e) || (len(card) > 2 && strings.EqualFold(card[2], e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// cardDetail is a card definition from the card list along with the number of times the deck references it.
+type cardDetail struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Count       int    `json:"count"`
+	// BaseName and Upgrade are the name without its upgrade suffix and the upgrade level, see parseUpgrade.
+	BaseName string `json:"base_name"`
+	Upgrade  int    `json:"upgrade"`
+}
+
+// parseUpgrade splits the trailing "+N" upgrade suffix off a card name, returning the base name and the upgrade
+// level. A bare "+" is a single upgrade, and names without a suffix have level 0.
+func parseUpgrade(name string) (string, int) {
+	i := strings.LastIndexByte(name, '+')
+	if i <= 0 {
+		return name, 0
+	}
+	if i == len(name)-1 {
+		return name[:i], 1
+	}
+	level, err := strconv.Atoi(name[i+1:])
+	if err != nil || name[i+1] < '0' || name[i+1] > '9' {
+		return name, 0
+	}
+	return name[:i], level
+}
+
+// detailFields are the names of the card fields in the detailed output, indexed by their position in a card.
+var detailFields = [...]string{"name", "description", "type"}
+
+// field returns the card field at position i of detailFields.
+func (d cardDetail) field(i int) string {
+	switch i {
+	case 0:
+		return d.Name
+	case 1:
+		return d.Description
+	default:
+		return d.Type
+	}
+}
+
+// detailFieldPositions returns the positions of the card fields named by fields, rejecting unknown names.
+func detailFieldPositions(fields []string) ([]int, error) {
+	positions := make([]int, 0, len(fields))
+	for _, field := range fields {
+		i := slices.Index(detailFields[:], strings.ToLower(strings.TrimSpace(field)))
+		if i < 0 {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		positions = append(positions, i)
+	}
+	return positions, nil
+}
+
+// selectDetailFields returns details with only the card fields at positions, along with the count which is always
+// kept.
+func selectDetailFields(details []cardDetail, positions []int) []gin.H {
+	result := make([]gin.H, 0, len(details))
+	for _, d := range details {
+		selected := gin.H{"count": d.Count}
+		for _, i := range positions {
+			selected[detailFields[i]] = d.field(i)
+		}
+		result = append(result, selected)
+	}
+	return result
+}
+
+type detailOptions struct {
+	// mergeIdentical collapses card definitions with identical fields at different indices into a single detail.
+	mergeIdentical bool
+}
+
+// decompressDeckDetailed returns the details of every card referenced by the deck, in card list order.
+func (p parser) decompressDeckDetailed(deck string, opts detailOptions) ([]cardDetail, error) {
+	d, cards, err := p.splitDeck(deck)
+	if err != nil {
+		return nil, err
+	}
+	return p.cardDetails(d, cards, opts)
+}
+
+// cardDetails returns the details of every card of cards referenced by the deck indices d, in card list order.
+func (p parser) cardDetails(d []int, cards [][]string, opts detailOptions) ([]cardDetail, error) {
+	counts := make([]int, len(cards))
+	for _, idx := range d {
+		counts[idx]++
+	}
+
+	result := make([]cardDetail, 0, len(cards))
+	// joined card fields -> index in result
+	merged := make(map[string]int)
+	for i, card := range cards {
+		if counts[i] == 0 {
+			continue
+		}
+		name := p.parseCard(card)
+		if opts.mergeIdentical {
+			// Cards are merged by their remapped name, so cards remapped to the same name merge too.
+			key := strings.Join(append([]string{name}, card[1:]...), p.FieldSeparator)
+			if len(card) < len(detailFields) {
+				// Missing fields are empty, so cards leaving them out merge with cards having them empty.
+				key += strings.Repeat(p.FieldSeparator, len(detailFields)-len(card))
+			}
+			if j, ok := merged[key]; ok {
+				result[j].Count += counts[i]
+				continue
+			}
+			merged[key] = len(result)
+		}
+		base, upgrade := parseUpgrade(name)
+		result = append(result, cardDetail{
+			Name:        name,
+			Description: cardField(card, 1),
+			Type:        cardField(card, 2),
+			Count:       counts[i],
+			BaseName:    base,
+			Upgrade:     upgrade,
+		})
+	}
+	return result, nil
+}
+
+// cardField returns field i of card, or an empty field for cards having fewer fields: some mod versions leave out the
+// trailing ones.
+func cardField(card []string, i int) string {
+	if i < len(card) {
+		return card[i]
+	}
+	return ""
 }
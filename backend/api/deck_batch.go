@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+// maxDeckBatchSize bounds the number of names of a batch deck request.
+const maxDeckBatchSize = 100
+
+// defaultBatchTimeout is how long a batch deck request waits for its decks to parse.
+const defaultBatchTimeout = 5 * time.Second
+
+// deckBatchResult is the response of a batch deck request, every requested name either in decks, in errors or in
+// timed out.
+type deckBatchResult struct {
+	// Decks are the rendered decks by name.
+	Decks map[string]string `json:"decks"`
+	// Errors are the reasons the other names have no deck, such as a deck that isn't stored or fails to decode.
+	Errors map[string]string `json:"errors"`
+	// TimedOut are the names whose deck was still parsing when the batch timed out.
+	TimedOut []string `json:"timed_out"`
+}
+
+// deckBatchItem is the rendered deck of a name of a batch, or the error rendering it.
+type deckBatchItem struct {
+	name string
+	body []byte
+	err  error
+}
+
+// batchTimedOut is called with the decks of a batch that weren't collected yet when it times out, tests use it to
+// finish a deck at the deadline.
+var batchTimedOut = func(items chan deckBatchItem) {}
+
+// postDecksBatchHandler serves the rendered decks of a JSON array of names in one response, for dashboards showing
+// many decks. Every deck is parsed on its own, so a missing or undecodable deck only fails its own name, and the
+// decks still parsing after the batch timeout are left out rather than failing the whole batch.
+func (a *API) postDecksBatchHandler(c *gin.Context) {
+	var names []string
+	err := c.BindJSON(&names)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(names) > maxDeckBatchSize {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("batch has more than %d names", maxDeckBatchSize)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), a.batchTimeout)
+	defer cancel()
+	result := deckBatchResult{Decks: make(map[string]string), Errors: make(map[string]string), TimedOut: []string{}}
+	// Buffered so the parses outliving the batch don't block.
+	items := make(chan deckBatchItem, len(names))
+	pending := make(map[string]bool)
+	for _, name := range names {
+		// Names resolve to the deck GET /deck/:name serves, and the "name:slot" keys to the deck of a slot.
+		e, _, ok := a.servedEntry(deckKey(name, ""))
+		if !ok {
+			result.Errors[name] = "deck not found"
+			continue
+		}
+		if pending[name] {
+			continue
+		}
+		pending[name] = true
+		go func(name string, d *deck) {
+			item := deckBatchItem{name: name}
+			item.err = d.parseContext(ctx, a.parser)
+			if item.err == nil {
+				item.body, item.err = d.Bytes(a.parser)
+			}
+			items <- item
+		}(name, e.deck)
+	}
+
+	collect := func(item deckBatchItem) {
+		delete(pending, item.name)
+		switch {
+		case errors.Is(item.err, context.DeadlineExceeded):
+			result.TimedOut = append(result.TimedOut, item.name)
+		case item.err != nil:
+			result.Errors[item.name] = a.batchDeckError(c, item.name, item.err)
+		default:
+			result.Decks[item.name] = string(item.body)
+		}
+	}
+	for len(pending) > 0 {
+		select {
+		case item := <-items:
+			collect(item)
+		case <-ctx.Done():
+			if err := c.Request.Context().Err(); err != nil {
+				c.JSON(503, gin.H{"error": err.Error()})
+				return
+			}
+			batchTimedOut(items)
+			// The decks finishing right at the deadline are served rather than reported as timed out.
+			for drained := false; !drained; {
+				select {
+				case item := <-items:
+					collect(item)
+				default:
+					drained = true
+				}
+			}
+			for _, name := range names {
+				if pending[name] {
+					result.TimedOut = append(result.TimedOut, name)
+					delete(pending, name)
+				}
+			}
+		}
+	}
+	slices.Sort(result.TimedOut)
+	c.JSON(200, result)
+}
+
+// batchDeckError returns the error reported for the deck of name failing to parse in a batch. As with deckParseError,
+// decks too large to render get their error, while the detail of the other errors is only logged outside of dev mode.
+func (a *API) batchDeckError(c *gin.Context, name string, err error) string {
+	if errors.Is(err, ErrRenderTooLarge) {
+		return err.Error()
+	}
+	ctx := c.Request.Context()
+	requestID := trace.SpanFromContext(ctx).SpanContext().TraceID().String()
+	o11y.Logger.ErrorCtx(ctx, "failed to parse deck", err,
+		slog.String("request_id", requestID),
+		slog.String("route", c.FullPath()),
+		slog.String("deck_name", name),
+	)
+	if a.devMode {
+		return err.Error()
+	}
+	return "failed to parse deck"
+}
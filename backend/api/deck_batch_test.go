@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestPostDecksBatchHandler(t *testing.T) {
+	a := newTestAPI(t, Options{DevMode: true})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck("other", newDeck("||0;;;Strike;a;Red"))
+	a.storeDeck("broken", newDeck("||3;;;Strike;a;Red"))
+
+	w := httptest.NewRecorder()
+	body := `["Streamer", "other", "missing", "broken"]`
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decks/batch", strings.NewReader(body)))
+	assert.Equal(t, w.Code, 200)
+
+	result := deckBatchResult{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.DeepEqual(t, result, deckBatchResult{
+		Decks: map[string]string{
+			"Streamer": "card1 x3\ncard2 x2\ncard3 x1\n",
+			"other":    "Strike x1\n",
+		},
+		Errors: map[string]string{
+			"missing": "deck not found",
+			"broken":  "deck is truncated: card index 3 beyond the 1 cards",
+		},
+		TimedOut: []string{},
+	})
+}
+
+func TestPostDecksBatchHandlerServedDecks(t *testing.T) {
+	const slowDeck = "||0;;;Slow;a;Red"
+	clock := newFakeClock()
+	a := newTestAPI(t, Options{
+		StaleWhileRevalidate: true,
+		DefaultDeck:          "||0;;;Strike;a;Red",
+		DeckTTL:              time.Minute,
+		clock:                clock,
+	})
+	a.storeDeck("evicted", newDeck(smallDeck))
+	clock.Advance(time.Minute + time.Nanosecond)
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck(deckKey("streamer", "ironclad"), newDeck("||0;;;Bash;b;Red"))
+	for _, key := range []string{"streamer", deckKey("streamer", "ironclad")} {
+		_, err := storedEntry(a, key).deck.Bytes(a.parser)
+		assert.NilError(t, err)
+	}
+	assert.Assert(t, a.wasEvicted("evicted"))
+
+	parsing := make(chan struct{})
+	release := make(chan struct{})
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		if raw == slowDeck {
+			close(parsing)
+			<-release
+		}
+	}
+	defer func() {
+		close(release)
+		_ = storedEntry(a, "streamer").deck.parse(a.parser)
+	}()
+	a.storeDeck("streamer", newDeck(slowDeck))
+	<-parsing
+
+	// A batch serves the deck of a name as GET /deck/:name does.
+	body := `["streamer", "streamer:ironclad", "unknown", "evicted"]`
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decks/batch", strings.NewReader(body)))
+	assert.Equal(t, w.Code, 200)
+	result := deckBatchResult{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.DeepEqual(t, result, deckBatchResult{
+		Decks: map[string]string{
+			"streamer":          "card1 x3\ncard2 x2\ncard3 x1\n",
+			"streamer:ironclad": "Bash x1\n",
+			"unknown":           "Strike x1\n",
+		},
+		Errors:   map[string]string{"evicted": "deck not found"},
+		TimedOut: []string{},
+	})
+	for _, name := range []string{"streamer", "streamer?slot=ironclad", "unknown"} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/"+name, nil))
+		assert.Equal(t, w.Body.String(), result.Decks[strings.Replace(name, "?slot=", ":", 1)])
+	}
+}
+
+func TestPostDecksBatchHandlerTimeout(t *testing.T) {
+	const slowDeck = "||0;;;Slow;a;Red"
+	// Enough parse slots that the slow deck can't hold up the other one.
+	a := newTestAPI(t, Options{BatchTimeout: 50 * time.Millisecond, MaxConcurrentParses: 2})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck("slow", newDeck(slowDeck))
+
+	release := make(chan struct{})
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		if raw == slowDeck {
+			<-release
+		}
+	}
+	defer func() {
+		// The hook is only restored once the slow parse, outliving the batch, is done with it.
+		close(release)
+		d, _ := a.getDeck("slow")
+		_ = d.parse(a.parser)
+	}()
+
+	w := httptest.NewRecorder()
+	body := `["streamer", "slow", "missing"]`
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decks/batch", strings.NewReader(body)))
+	assert.Equal(t, w.Code, 200)
+
+	result := deckBatchResult{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.DeepEqual(t, result, deckBatchResult{
+		Decks:    map[string]string{"streamer": "card1 x3\ncard2 x2\ncard3 x1\n"},
+		Errors:   map[string]string{"missing": "deck not found"},
+		TimedOut: []string{"slow"},
+	})
+}
+
+func TestPostDecksBatchHandlerDeadline(t *testing.T) {
+	const slowDeck = "||0;;;Slow;a;Red"
+	a := newTestAPI(t, Options{BatchTimeout: 50 * time.Millisecond, MaxConcurrentParses: 2})
+	a.storeDeck("slow", newDeck(slowDeck))
+
+	release := make(chan struct{})
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		if raw == slowDeck {
+			<-release
+		}
+	}
+	defer func(hook func(chan deckBatchItem)) { batchTimedOut = hook }(batchTimedOut)
+	batchTimedOut = func(items chan deckBatchItem) {
+		// The slow deck finishes once the batch timed out, before it's collected.
+		close(release)
+		deadline := time.Now().Add(5 * time.Second)
+		for len(items) == 0 {
+			assert.Assert(t, time.Now().Before(deadline))
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decks/batch", strings.NewReader(`["slow"]`)))
+	assert.Equal(t, w.Code, 200)
+
+	result := deckBatchResult{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.DeepEqual(t, result, deckBatchResult{
+		Decks:    map[string]string{"slow": "Slow x1\n"},
+		Errors:   map[string]string{},
+		TimedOut: []string{},
+	})
+}
+
+func TestPostDecksBatchHandlerInvalid(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	names := make([]string, maxDeckBatchSize+1)
+	for i := range names {
+		names[i] = fmt.Sprintf("streamer%d", i)
+	}
+	tooMany, err := json.Marshal(names)
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		desc string
+		body string
+		err  string
+	}{
+		{
+			desc: "Too many names",
+			body: string(tooMany),
+			err:  `{"error":"batch has more than 100 names"}`,
+		},
+		{
+			desc: "Not an array",
+			body: `{"names": ["streamer"]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decks/batch", strings.NewReader(tc.body)))
+			assert.Equal(t, w.Code, 400)
+			if tc.err != "" {
+				assert.Equal(t, w.Body.String(), tc.err)
+			}
+		})
+	}
+	// Outside of dev mode, only the errors of decks too large to render are detailed.
+	a = newTestAPI(t, Options{MaxRenderedSize: 16})
+	a.storeDeck("broken", newDeck("||3;;;Strike;a;Red"))
+	a.storeDeck("large", newDeck(smallDeck))
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/decks/batch", strings.NewReader(`["broken", "large"]`)))
+	assert.Equal(t, w.Code, 200)
+	result := deckBatchResult{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.DeepEqual(t, result.Errors, map[string]string{
+		"broken": "failed to parse deck",
+		"large":  "rendered deck is too large: 27 bytes, above the 16 bytes limit",
+	})
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deckHistorySize is the number of decks replaced under a name that are kept to serve deltas from.
+const deckHistorySize = 8
+
+// deckSnapshot is a deck replaced under a name, and the generation it was stored with.
+type deckSnapshot struct {
+	generation uint64
+	deck       *deck
+}
+
+// withHistory returns the history of e followed by e itself, keeping the last deckHistorySize decks.
+func (e *deckEntry) withHistory() []deckSnapshot {
+	history := e.history
+	if len(history) >= deckHistorySize {
+		history = history[len(history)-deckHistorySize+1:]
+	}
+	// The history of e is shared with readers of e, so it's copied rather than appended to.
+	result := make([]deckSnapshot, 0, len(history)+1)
+	result = append(result, history...)
+	return append(result, deckSnapshot{generation: e.generation, deck: e.deck})
+}
+
+// snapshot returns the deck stored under the name of e at generation, if it's e's or still in its history.
+func (e *deckEntry) snapshot(generation uint64) (*deck, bool) {
+	if generation == e.generation {
+		return e.deck, true
+	}
+	for _, s := range e.history {
+		if s.generation == generation {
+			return s.deck, true
+		}
+	}
+	return nil, false
+}
+
+// deckDelta is the change of the card counts of a deck since an earlier generation.
+type deckDelta struct {
+	// Base is the generation the delta applies to.
+	Base       uint64 `json:"base"`
+	Generation uint64 `json:"generation"`
+	// Added and Removed are the number of copies of each card added and removed since the base generation.
+	Added   map[string]int `json:"added"`
+	Removed map[string]int `json:"removed"`
+}
+
+// diffCounts returns the copies of each card added and removed going from the card counts from to to.
+func diffCounts(from, to map[string]int) (added, removed map[string]int) {
+	added, removed = make(map[string]int), make(map[string]int)
+	for card, count := range to {
+		if diff := count - from[card]; diff > 0 {
+			added[card] = diff
+		}
+	}
+	for card, count := range from {
+		if diff := count - to[card]; diff > 0 {
+			removed[card] = diff
+		}
+	}
+	return added, removed
+}
+
+// writeDeckDelta responds with the deckDelta of e since the generation of the If-Deck-Generation header, reporting
+// whether it did. The full deck is left to the caller when the generation isn't known, or its deck fails to parse.
+func (a *API) writeDeckDelta(c *gin.Context, e *deckEntry) bool {
+	base, err := strconv.ParseUint(c.GetHeader(deckBaseGenerationHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	previous, ok := e.snapshot(base)
+	if !ok {
+		return false
+	}
+	if !a.awaitParse(c, previous) {
+		return true
+	}
+	from, err := previous.Counts(a.parser, nil)
+	if err != nil {
+		return false
+	}
+	to, err := e.deck.Counts(a.parser, nil)
+	if err != nil {
+		a.deckParseError(c, err)
+		return true
+	}
+
+	added, removed := diffCounts(from, to)
+	c.JSON(200, deckDelta{Base: base, Generation: e.generation, Added: added, Removed: removed})
+	return true
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGetDeckHandlerDelta(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	first := storedEntry(a, "streamer").generation
+	a.storeDeck("streamer", newDeck("||0,0,1,1;;;card1;a;x;;Strike;a;Red"))
+
+	get := func(generation string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/deck/streamer", nil)
+		req.Header.Set(deckBaseGenerationHeader, generation)
+		a.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		return w
+	}
+
+	w := get(strconv.FormatUint(first, 10))
+	delta := deckDelta{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &delta))
+	assert.DeepEqual(t, delta, deckDelta{
+		Base:       first,
+		Generation: first + 1,
+		Added:      map[string]int{"Strike": 2},
+		Removed:    map[string]int{"card1": 1, "card2": 2, "card3": 1},
+	})
+
+	w = get(strconv.FormatUint(first+1, 10))
+	delta = deckDelta{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &delta))
+	assert.DeepEqual(t, delta, deckDelta{
+		Base:       first + 1,
+		Generation: first + 1,
+		Added:      map[string]int{},
+		Removed:    map[string]int{},
+	})
+
+	for _, generation := range []string{"", "99", "invalid"} {
+		w = get(generation)
+		assert.Equal(t, w.Body.String(), "Strike x2\ncard1 x2\n")
+	}
+}
+
+func TestDeckHistorySize(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	first := storedEntry(a, "streamer").generation
+	for i := 0; i <= deckHistorySize; i++ {
+		a.storeDeck("streamer", newDeck("||0;;;Strike"+strconv.Itoa(i)+";a;Red"))
+	}
+
+	e := storedEntry(a, "streamer")
+	assert.Equal(t, len(e.history), deckHistorySize)
+	_, ok := e.snapshot(first)
+	assert.Assert(t, !ok)
+	_, ok = e.snapshot(first + 1)
+	assert.Assert(t, ok)
+}
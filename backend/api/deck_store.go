@@ -0,0 +1,662 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+// deck is a stored compressed deck. It is parsed at most once, on first read, and shared by every name storing
+// identical compressed bytes.
+type deck struct {
+	raw string
+	// format is the version of the wire format raw is encoded with.
+	format int
+	hash   [sha256.Size]byte
+	// pins are the cards listed after the others uploaded with the deck, replacing the configured ones if any.
+	pins []string
+	// refs is the number of names storing this deck, guarded by API.deckLock.
+	refs int
+
+	parseOnce sync.Once
+	parsedDeck
+	err error
+	// size is the number of bytes held by the deck, raw and rendered.
+	size atomic.Int64
+	// encodings caches the compressed forms of the rendered deck.
+	encodings encodingCache
+	// parsed is set once the deck is parsed, so readers of parsed decks skip waiting for a parse slot.
+	parsed atomic.Bool
+	// msgpack caches the MsgPack encoding of the deck, msgpackEncodings its compressed forms.
+	msgpackOnce      sync.Once
+	msgpack          []byte
+	msgpackErr       error
+	msgpackEncodings encodingCache
+}
+
+func newDeck(raw string) *deck {
+	return newVersionedDeck(raw, deckFormatV1)
+}
+
+// newVersionedDeck returns the deck raw encoded with the given wire format version.
+func newVersionedDeck(raw string, format int) *deck {
+	return newPinnedDeck(raw, format, nil)
+}
+
+// newPinnedDeck is newVersionedDeck, listing the cards pins after the others instead of the configured pinned cards if
+// there are any.
+func newPinnedDeck(raw string, format int, pins []string) *deck {
+	h := sha256.New()
+	_, _ = h.Write([]byte{byte(format)})
+	_, _ = h.Write([]byte(raw))
+	// Identical decks with different pins render differently, so they mustn't be shared.
+	for _, pin := range pins {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(pin))
+	}
+	d := &deck{raw: raw, format: format, pins: pins}
+	h.Sum(d.hash[:0])
+	d.size.Store(int64(len(raw)))
+	return d
+}
+
+// beforeParse is called with the compressed deck before every parse, tests use it to slow parses down.
+var beforeParse = func(raw string) {}
+
+// shortHashSize is the number of bytes of the deck hash in its short hash.
+const shortHashSize = 4
+
+// shortHash returns the short hash of the deck, for shareable links.
+func (d *deck) shortHash() string {
+	return hex.EncodeToString(d.hash[:shortHashSize])
+}
+
+// getDeckByHash returns the stored deck whose short hash is hash.
+func (a *API) getDeckByHash(hash string) (*deck, bool) {
+	a.deckLock.RLock()
+	defer a.deckLock.RUnlock()
+	d, ok := a.shortHashes[strings.ToLower(hash)]
+	return d, ok
+}
+
+// parse decodes the deck with p the first time it's called and returns the result of that first parse. Only readers
+// of this deck wait for the parse, no lock is held while parsing.
+func (d *deck) parse(p parser) error {
+	_, err := d.parseCold(p)
+	return err
+}
+
+// parseCold is parse, also reporting whether this call is the one that parsed the deck.
+func (d *deck) parseCold(p parser) (cold bool, err error) {
+	d.parseOnce.Do(func() {
+		cold = true
+		// Decks with identical contents that aren't interned, such as a deck stored again after its previous copy was
+		// evicted while a request still parses it, share a single concurrent parse.
+		parsed, err, _ := p.flights.Do(string(d.hash[:]), func() (any, error) {
+			beforeParse(d.raw)
+			if p.stats != nil {
+				p.stats.coldParses.Add(1)
+			}
+			switch d.format {
+			case deckFormatV1:
+				return p.withPins(d.pins).parseDeck(d.raw)
+			default:
+				return parsedDeck{}, fmt.Errorf("unsupported deck format %d", d.format)
+			}
+		})
+		d.parsedDeck, d.err = parsed.(parsedDeck), err
+		d.size.Add(int64(len(d.rendered)))
+		d.parsed.Store(true)
+	})
+	return cold, d.err
+}
+
+// parseContext is parse, waiting for a parse slot of p first unless d is already parsed, so a burst of cold decks
+// can't starve the reads of warm ones. It returns the error of ctx if ctx is done while waiting.
+func (d *deck) parseContext(ctx context.Context, p parser) error {
+	if p.parseSlots == nil || d.parsed.Load() {
+		return d.parseTraced(ctx, p)
+	}
+	select {
+	case p.parseSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.parseSlots }()
+	return d.parseTraced(ctx, p)
+}
+
+// parseTraced is parse, adding the details of the deck to the span of ctx if this call parsed it, so the traces of
+// slow requests show the decks they parsed.
+func (d *deck) parseTraced(ctx context.Context, p parser) error {
+	cold, err := d.parseCold(p)
+	if !cold {
+		return err
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("deck.cold", true))
+	if err == nil {
+		span.SetAttributes(
+			attribute.Int("deck.cards.total", len(d.indices)),
+			attribute.Int("deck.cards.unique", d.unique),
+			attribute.Int("deck.dictionary.size", d.dictSize),
+			attribute.Int("deck.substitutions", d.substitutions),
+		)
+	}
+	return err
+}
+
+// awaitParse parses d within the parse concurrency limit, responding with a 503 if the request is done first. Decode
+// errors are left to the caller, which gets them from d again.
+func (a *API) awaitParse(c *gin.Context, d *deck) bool {
+	err := d.parseContext(c.Request.Context(), a.parser)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(503, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// parsedDeck is the decoded form of a compressed deck.
+type parsedDeck struct {
+	indices  []int
+	cards    [][]string
+	rendered []byte
+	// unique is the number of distinct cards, dictSize the number of compression dictionary entries.
+	unique   int
+	dictSize int
+	// substitutions is the number of wildcards expanded while decompressing.
+	substitutions int
+}
+
+// ErrRenderTooLarge is returned for decks decoding fine whose rendering is above the MaxRenderedSize.
+var ErrRenderTooLarge = errors.New("rendered deck is too large")
+
+// parseDeck decodes the compressed deck raw, independently of any stored deck.
+func (p parser) parseDeck(raw string) (parsedDeck, error) {
+	indices, cards, substitutions, err := p.splitDeckCounted(raw)
+	if err != nil {
+		return parsedDeck{}, err
+	}
+	if len(indices) > p.expectedMaxDeckSize {
+		reportOversizedDeck(len(indices), p.expectedMaxDeckSize)
+	}
+	counts, err := p.countCardsLimited(indices, cards, nil, p.maxUniqueCards)
+	if err != nil {
+		return parsedDeck{}, err
+	}
+	if err := p.checkRenderedSize(p.framedSize(renderedSize(counts), len(indices), len(counts))); err != nil {
+		return parsedDeck{}, err
+	}
+	return parsedDeck{
+		indices:  indices,
+		cards:    cards,
+		rendered: p.frameDeck(p.renderDeck(counts), len(indices), len(counts)),
+		unique:   len(counts),
+		dictSize: len(p.dictionary(raw)),
+
+		substitutions: substitutions,
+	}, nil
+}
+
+// noopMeter records the deck parse metrics until o11y.Init sets o11y.Meter, so decks decode without metrics set up,
+// such as in tests and benchmarks of the parser alone.
+var noopMeter = noop.NewMeterProvider().Meter("")
+
+// parseInstruments are the instruments of the metrics recorded while parsing decks.
+type parseInstruments struct {
+	// meter is the meter the instruments were created with.
+	meter         metric.Meter
+	oversize      metric.Int64Counter
+	ratio         metric.Float64Histogram
+	substitutions metric.Int64Histogram
+}
+
+var cachedParseInstruments atomic.Pointer[parseInstruments]
+
+// getParseInstruments returns the parse instruments of o11y.Meter, only creating them again once the meter changes
+// rather than on every parse.
+func getParseInstruments() *parseInstruments {
+	meter := o11y.Meter
+	if meter == nil {
+		meter = noopMeter
+	}
+	if cached := cachedParseInstruments.Load(); cached != nil && cached.meter == meter {
+		return cached
+	}
+	instruments := &parseInstruments{meter: meter}
+	instruments.oversize, _ = meter.Int64Counter("deck.oversize")
+	instruments.ratio, _ = meter.Float64Histogram("deck.compression.ratio")
+	instruments.substitutions, _ = meter.Int64Histogram("deck.substitutions")
+	cachedParseInstruments.Store(instruments)
+	return instruments
+}
+
+// reportOversizedDeck counts and logs a deck of size cards, above the expected max, which likely comes from a
+// serialization bug in the mod. The deck is still stored, as it decoded fine.
+func reportOversizedDeck(size, expected int) {
+	if oversizeCounter := getParseInstruments().oversize; oversizeCounter != nil {
+		oversizeCounter.Add(context.Background(), 1)
+	}
+	o11y.Logger.Warn("deck larger than expected", slog.Int("size", size), slog.Int("expected_max", expected))
+}
+
+// recordCompressionRatio records how many times larger a decompressed deck of size bytes is than its compressed form
+// of compressed bytes, to track how well the mod's compression does on real decks.
+func recordCompressionRatio(size, compressed int) {
+	if ratioHistogram := getParseInstruments().ratio; ratioHistogram != nil && compressed > 0 {
+		ratioHistogram.Record(context.Background(), float64(size)/float64(compressed))
+	}
+}
+
+// recordSubstitutions records the number of wildcards expanded while decompressing a deck.
+func recordSubstitutions(n int) {
+	if substitutionsHistogram := getParseInstruments().substitutions; substitutionsHistogram != nil {
+		substitutionsHistogram.Record(context.Background(), int64(n))
+	}
+}
+
+// Bytes returns the rendered deck.
+func (d *deck) Bytes(p parser) ([]byte, error) {
+	err := d.parse(p)
+	return d.rendered, err
+}
+
+// Counts returns the number of copies of each card in the deck, skipping every card whose name or type
+// case-insensitively matches one of exclude.
+func (d *deck) Counts(p parser, exclude []string) (map[string]int, error) {
+	err := d.parse(p)
+	if err != nil {
+		return nil, err
+	}
+	return p.countCards(d.indices, d.cards, exclude), nil
+}
+
+// Summary returns the number of cards in the deck and the number of distinct cards among them.
+func (d *deck) Summary(p parser) (total, unique int, err error) {
+	err = d.parse(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(d.indices), d.unique, nil
+}
+
+// Details returns the details of every card in the deck, identical card definitions merged.
+func (d *deck) Details(p parser) ([]cardDetail, error) {
+	err := d.parse(p)
+	if err != nil {
+		return nil, err
+	}
+	return p.cardDetails(d.indices, d.cards, detailOptions{mergeIdentical: true})
+}
+
+// msgpackHandle encodes strings with the current MsgPack spec, which every decoder understands.
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// deckMsgPack is the MsgPack form of a deck, the deckResult of the JSON format without the generation, which is a
+// property of the name the deck is stored under.
+type deckMsgPack struct {
+	Cards  []cardDetail `codec:"cards"`
+	Total  int          `codec:"total"`
+	Unique int          `codec:"unique"`
+}
+
+// MsgPack returns the card details of the deck along with its card counts encoded as MsgPack, encoding them only the
+// first time.
+func (d *deck) MsgPack(p parser) ([]byte, error) {
+	d.msgpackOnce.Do(func() {
+		d.msgpack, d.msgpackErr = d.encodeMsgPack(p, nil)
+	})
+	return d.msgpack, d.msgpackErr
+}
+
+// encodeMsgPack encodes the card details of the deck along with its card counts as MsgPack, the card names translated
+// with translation if it's set.
+func (d *deck) encodeMsgPack(p parser, translation map[string]string) ([]byte, error) {
+	details, err := d.Details(p)
+	if err != nil {
+		return nil, err
+	}
+	if translation != nil {
+		translateDetails(details, translation)
+	}
+	total, unique, err := d.Summary(p)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	err = codec.NewEncoderBytes(&body, msgpackHandle).Encode(deckMsgPack{
+		Cards:  details,
+		Total:  total,
+		Unique: unique,
+	})
+	return body, err
+}
+
+// CountsByType is Counts grouped by card type.
+func (d *deck) CountsByType(p parser, exclude []string) (map[string]map[string]int, error) {
+	err := d.parse(p)
+	if err != nil {
+		return nil, err
+	}
+	return p.countCardsByType(d.indices, d.cards, exclude), nil
+}
+
+// deckEntry is a deck stored under a name.
+type deckEntry struct {
+	deck *deck
+	// generation increases every time a deck is stored under the name, even an identical one.
+	generation uint64
+	// lastAccess is the unix nano time the deck was last stored or read under this name.
+	lastAccess atomic.Int64
+	// stale is the entry replaced by this one, served until deck is parsed if staleWhileRevalidate.
+	stale atomic.Pointer[deckEntry]
+	// history holds the last decks replaced under the name, oldest first, to serve deltas from.
+	history []deckSnapshot
+}
+
+// served returns the entry to serve in place of e: the entry e replaced while e's deck is still being parsed, if
+// it's kept, and e otherwise.
+func (e *deckEntry) served() *deckEntry {
+	stale := e.stale.Load()
+	if stale == nil {
+		return e
+	}
+	if e.deck.parsed.Load() {
+		e.stale.Store(nil)
+		return e
+	}
+	return stale
+}
+
+// maxEvictedNames bounds the number of evicted names remembered to tell evicted decks apart from unknown ones.
+const maxEvictedNames = 1024
+
+// slotSeparator separates a name from the slot in the key of a slot deck. Twitch logins never contain it.
+const slotSeparator = ":"
+
+// deckKey returns the key the deck of name is stored under, that of one of its slots if slot isn't empty.
+func deckKey(name, slot string) string {
+	name = strings.ToLower(name)
+	if slot == "" {
+		return name
+	}
+	return name + slotSeparator + strings.ToLower(slot)
+}
+
+// getSlotDecks returns the decks stored under name and under every slot of name.
+func (a *API) getSlotDecks(name string) []*deck {
+	keys := func() []string {
+		a.deckLock.RLock()
+		defer a.deckLock.RUnlock()
+		var keys []string
+		for key := range a.deckLists {
+			if key == name || strings.HasPrefix(key, name+slotSeparator) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}()
+
+	decks := make([]*deck, 0, len(keys))
+	for _, key := range keys {
+		if d, ok := a.getDeck(key); ok {
+			decks = append(decks, d)
+		}
+	}
+	return decks
+}
+
+func (a *API) getDeck(name string) (*deck, bool) {
+	e, ok := a.getDeckEntry(name)
+	if !ok {
+		return nil, false
+	}
+	return e.deck, true
+}
+
+// servedEntry returns the entry served for the deck stored under key: the entry it replaced while its deck is still
+// parsing if kept, and the default deck, reported by isDefault, for keys never stored.
+func (a *API) servedEntry(key string) (e *deckEntry, isDefault bool, ok bool) {
+	e, ok = a.getDeckEntry(key)
+	if ok {
+		return e.served(), false, true
+	}
+	if a.defaultDeck != nil && !a.wasEvicted(key) {
+		return a.defaultDeck, true, true
+	}
+	return nil, false, false
+}
+
+// getDeckEntry returns the entry of the deck stored under name, if it's stored and not expired.
+func (a *API) getDeckEntry(name string) (*deckEntry, bool) {
+	now := a.clock.Now()
+
+	e, ok := func() (*deckEntry, bool) {
+		a.deckLock.RLock()
+		defer a.deckLock.RUnlock()
+		e, ok := a.deckLists[name]
+		return e, ok
+	}()
+	if !ok {
+		a.stats.misses.Add(1)
+		return nil, false
+	}
+
+	if a.expired(e, now) {
+		a.stats.misses.Add(1)
+		a.deckLock.Lock()
+		defer a.deckLock.Unlock()
+		if current, ok := a.deckLists[name]; ok && current == e && a.expired(e, now) {
+			a.evictDeck(name)
+		}
+		return nil, false
+	}
+
+	e.lastAccess.Store(now.UnixNano())
+	a.stats.hits.Add(1)
+	return e, true
+}
+
+// storeDeck stores d under name and publishes it to the name's stream subscribers. If a deck with identical
+// compressed bytes is already stored under any name, that deck is shared instead so it's only parsed once.
+func (a *API) storeDeck(name string, d *deck) {
+	name = strings.ToLower(name)
+	e := a.storeDeckLocked(name, d)
+	d = e.deck
+	if a.staleWhileRevalidate && !d.parsed.Load() {
+		// Readers are served the replaced deck meanwhile, nothing waits for this parse.
+		go func() { _ = d.parseContext(context.Background(), a.parser) }()
+	}
+	a.publishDeck(name, e)
+}
+
+// storeDeckLocked stores d under name, returning the entry actually stored.
+func (a *API) storeDeckLocked(name string, d *deck) *deckEntry {
+	now := a.clock.Now()
+
+	a.deckLock.Lock()
+	defer a.deckLock.Unlock()
+
+	if interned, ok := a.decks[d.hash]; ok {
+		d = interned
+	} else {
+		a.decks[d.hash] = d
+		if _, ok := a.shortHashes[d.shortHash()]; !ok {
+			a.shortHashes[d.shortHash()] = d
+		}
+	}
+	d.refs++
+
+	// Generations are shared by every name so they keep increasing across evictions.
+	a.generation++
+	e := &deckEntry{deck: d, generation: a.generation}
+	if old, ok := a.deckLists[name]; ok {
+		a.releaseDeck(old.deck)
+		e.history = old.withHistory()
+		if a.staleWhileRevalidate && !d.parsed.Load() {
+			if served := old.served(); served.deck.parsed.Load() {
+				e.stale.Store(served)
+			}
+		}
+	}
+	e.lastAccess.Store(now.UnixNano())
+	a.deckLists[name] = e
+	delete(a.evicted, name)
+
+	a.evictDecks(now)
+	return e
+}
+
+// ClearDecks forgets every stored deck, including the names of evicted decks, ending the streams of the names decks were
+// stored under as evicting them does.
+func (a *API) ClearDecks() {
+	names := func() []string {
+		a.deckLock.Lock()
+		defer a.deckLock.Unlock()
+
+		names := make([]string, 0, len(a.deckLists))
+		for name := range a.deckLists {
+			names = append(names, name)
+		}
+		a.deckLists = make(map[string]*deckEntry)
+		a.decks = make(map[[sha256.Size]byte]*deck)
+		a.shortHashes = make(map[string]*deck)
+		a.evicted = make(map[string]time.Time)
+		return names
+	}()
+	for _, name := range names {
+		a.streams.drop(name)
+	}
+}
+
+// deleteDecksHandler clears the stored decks, for operational resets.
+func (a *API) deleteDecksHandler(c *gin.Context) {
+	a.ClearDecks()
+	c.Data(200, "text/plain", []byte("Success\n"))
+}
+
+// postEvictDeckHandler evicts the deck stored under a name along with its history, such as a corrupt deck, ending the
+// streams of the name. It responds with a 404 if no deck is stored under the name.
+func (a *API) postEvictDeckHandler(c *gin.Context) {
+	name := deckKey(c.Param("name"), c.Query("slot"))
+
+	ok := func() bool {
+		a.deckLock.Lock()
+		defer a.deckLock.Unlock()
+		_, ok := a.deckLists[name]
+		a.evictDeck(name)
+		return ok
+	}()
+	if !ok {
+		c.JSON(404, gin.H{"error": "deck not found"})
+		return
+	}
+	a.streams.drop(name)
+	c.Status(204)
+}
+
+// releaseDeck drops a reference to d, forgetting it once no name stores it anymore. deckLock must be held.
+func (a *API) releaseDeck(d *deck) {
+	d.refs--
+	if d.refs <= 0 {
+		delete(a.decks, d.hash)
+		if a.shortHashes[d.shortHash()] == d {
+			delete(a.shortHashes, d.shortHash())
+		}
+	}
+}
+
+func (a *API) expired(e *deckEntry, now time.Time) bool {
+	return a.deckTTL > 0 && now.Sub(time.Unix(0, e.lastAccess.Load())) > a.deckTTL
+}
+
+// evictDecks evicts the decks that haven't been accessed within the deck TTL, then the least recently accessed decks
+// while there are more than the maximum number of decks. deckLock must be held.
+func (a *API) evictDecks(now time.Time) {
+	if a.deckTTL > 0 {
+		for name, e := range a.deckLists {
+			if a.expired(e, now) {
+				a.evictDeck(name)
+			}
+		}
+	}
+
+	for a.maxDecks > 0 && len(a.deckLists) > a.maxDecks {
+		oldestName := ""
+		oldest := int64(math.MaxInt64)
+		for name, e := range a.deckLists {
+			if access := e.lastAccess.Load(); access < oldest {
+				oldestName, oldest = name, access
+			}
+		}
+		a.evictDeck(oldestName)
+	}
+}
+
+// evictDeck removes the deck stored under name, remembering the name was evicted. deckLock must be held.
+func (a *API) evictDeck(name string) {
+	e, ok := a.deckLists[name]
+	if !ok {
+		return
+	}
+	delete(a.deckLists, name)
+	a.releaseDeck(e.deck)
+
+	if len(a.evicted) >= maxEvictedNames {
+		oldestName := ""
+		var oldest time.Time
+		for evictedName, at := range a.evicted {
+			if oldestName == "" || at.Before(oldest) {
+				oldestName, oldest = evictedName, at
+			}
+		}
+		delete(a.evicted, oldestName)
+	}
+	a.evicted[name] = a.clock.Now()
+}
+
+// wasEvicted reports whether the deck stored under name was recently evicted.
+func (a *API) wasEvicted(name string) bool {
+	a.deckLock.RLock()
+	defer a.deckLock.RUnlock()
+	_, ok := a.evicted[name]
+	return ok
+}
+
+// deckNotFound responds with the missing deck status for name, counting whether the deck was evicted or never stored.
+// Misses are never cacheable, so the deck shows up as soon as it's uploaded.
+func (a *API) deckNotFound(c *gin.Context, name string) {
+	reason := "unknown"
+	if a.wasEvicted(name) {
+		reason = "evicted"
+	}
+	notFoundCounter, _ := o11y.Meter.Int64Counter("deck.not_found")
+	if notFoundCounter != nil {
+		notFoundCounter.Add(c.Request.Context(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if a.missingDeckStatus == 204 {
+		c.Status(204)
+		return
+	}
+	c.JSON(a.missingDeckStatus, gin.H{"error": "deck not found"})
+}
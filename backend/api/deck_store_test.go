@@ -0,0 +1,766 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gotest.tools/v3/assert"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+// storedEntry returns the entry stored under name, without counting an access to it.
+func storedEntry(a *API, name string) *deckEntry {
+	a.deckLock.RLock()
+	defer a.deckLock.RUnlock()
+	return a.deckLists[name]
+}
+
+// storedDeckCount returns the number of names decks are stored under.
+func storedDeckCount(a *API) int {
+	a.deckLock.RLock()
+	defer a.deckLock.RUnlock()
+	return len(a.deckLists)
+}
+
+func TestStoreDeckInterned(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	for _, name := range []string{"streamer", "Other"} {
+		a.storeDeck(name, newDeck(smallDeck))
+	}
+	assert.Equal(t, len(a.decks), 1)
+	assert.Equal(t, storedEntry(a, "streamer").deck, storedEntry(a, "other").deck)
+	assert.Equal(t, storedEntry(a, "streamer").deck.refs, 2)
+
+	for _, name := range []string{"streamer", "other"} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/"+name, nil))
+		assert.Equal(t, w.Code, 200)
+		assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+	}
+	streamer, err := storedEntry(a, "streamer").deck.Bytes(a.parser)
+	assert.NilError(t, err)
+	other, err := storedEntry(a, "other").deck.Bytes(a.parser)
+	assert.NilError(t, err)
+	assert.Equal(t, &streamer[0], &other[0])
+
+	// Replacing a deck releases the shared one, which is forgotten once no name stores it.
+	a.storeDeck("streamer", newDeck("||0;;;Strike;a;b"))
+	assert.Equal(t, len(a.decks), 2)
+	assert.Equal(t, storedEntry(a, "other").deck.refs, 1)
+
+	a.storeDeck("other", newDeck("||0;;;Strike;a;b"))
+	assert.Equal(t, len(a.decks), 1)
+	assert.Equal(t, storedEntry(a, "streamer").deck, storedEntry(a, "other").deck)
+	assert.Equal(t, storedEntry(a, "streamer").deck.refs, 2)
+
+	// Storing the same deck again under the same name doesn't leak a reference.
+	a.storeDeck("other", newDeck("||0;;;Strike;a;b"))
+	assert.Equal(t, storedEntry(a, "other").deck.refs, 2)
+}
+
+func TestPostDeckHandlerInterned(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("other", newDeck(smallDeck))
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.Equal(t, storedEntry(a, "streamer").deck, storedEntry(a, "other").deck)
+	assert.Equal(t, len(a.decks), 1)
+}
+
+// fakeClock is a clock only moving when advanced.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDeckEviction(t *testing.T) {
+	getDeck := func(a *API, name string) int {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/"+name, nil))
+		return w.Code
+	}
+	evicted := attribute.String("reason", "evicted")
+	unknown := attribute.String("reason", "unknown")
+
+	t.Run("TTL", func(t *testing.T) {
+		clock := newFakeClock()
+		a := newTestAPI(t, Options{DeckTTL: time.Minute, clock: clock})
+		reader := newTestMeter(t)
+
+		a.storeDeck("streamer", newDeck(smallDeck))
+		clock.Advance(time.Minute)
+		// Reading the deck at the end of its TTL keeps it for another TTL.
+		assert.Equal(t, getDeck(a, "streamer"), 200)
+		clock.Advance(time.Minute)
+		assert.Equal(t, getDeck(a, "streamer"), 200)
+		clock.Advance(time.Minute + time.Nanosecond)
+
+		assert.Equal(t, getDeck(a, "streamer"), 404)
+		assert.Equal(t, counterValue(t, reader, "deck.not_found", evicted), int64(1))
+		assert.Equal(t, storedDeckCount(a), 0)
+		assert.Equal(t, len(a.decks), 0)
+
+		assert.Equal(t, getDeck(a, "never-stored"), 404)
+		assert.Equal(t, counterValue(t, reader, "deck.not_found", evicted), int64(1))
+		assert.Equal(t, counterValue(t, reader, "deck.not_found", unknown), int64(1))
+
+		// Storing the deck again makes it available, as no longer evicted.
+		a.storeDeck("streamer", newDeck(smallDeck))
+		assert.Equal(t, getDeck(a, "streamer"), 200)
+		assert.Equal(t, a.wasEvicted("streamer"), false)
+	})
+
+	t.Run("MaxDecks", func(t *testing.T) {
+		clock := newFakeClock()
+		a := newTestAPI(t, Options{MaxDecks: 2, clock: clock})
+		reader := newTestMeter(t)
+
+		a.storeDeck("a", newDeck(smallDeck))
+		clock.Advance(time.Second)
+		a.storeDeck("b", newDeck(smallDeck))
+		clock.Advance(time.Second)
+		// Reading a makes b the least recently accessed.
+		assert.Equal(t, getDeck(a, "a"), 200)
+		clock.Advance(time.Second)
+		a.storeDeck("c", newDeck("||0;;;Strike;a;b"))
+
+		assert.Equal(t, storedDeckCount(a), 2)
+		assert.Equal(t, getDeck(a, "b"), 404)
+		assert.Equal(t, getDeck(a, "a"), 200)
+		assert.Equal(t, getDeck(a, "c"), 200)
+		assert.Equal(t, counterValue(t, reader, "deck.not_found", evicted), int64(1))
+	})
+}
+
+func TestMissingDeckStatus(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		status int
+		code   int
+		body   string
+	}{
+		{desc: "Default", status: 0, code: 404, body: `{"error":"deck not found"}`},
+		{desc: "OK", status: 200, code: 200, body: `{"error":"deck not found"}`},
+		{desc: "No content", status: 204, code: 204, body: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, Options{MissingDeckStatus: tc.status})
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Body.String(), tc.body)
+			assert.Equal(t, w.Header().Get("Cache-Control"), "no-store")
+		})
+	}
+
+	_, err := New(nil, usersStub{}, nil, Options{MissingDeckStatus: 500})
+	assert.Error(t, err, "unsupported missing deck status 500")
+}
+
+func TestDefaultDeck(t *testing.T) {
+	clock := newFakeClock()
+	a := newTestAPI(t, Options{DefaultDeck: "||0,0,1;;;Strike;a;Red;;Bash;b;Red", MaxDecks: 1, clock: clock})
+	get := func(name string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/"+name, nil))
+		return w
+	}
+
+	w := get("newcomer")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "Bash x1\nStrike x2\n")
+	assert.Equal(t, w.Header().Get("Cache-Control"), "no-store")
+
+	// Stored decks replace the default deck, which isn't served for the evicted ones either.
+	a.storeDeck("streamer", newDeck(smallDeck))
+	w = get("streamer")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+	clock.Advance(time.Second)
+	a.storeDeck("other", newDeck(smallDeck))
+	assert.Equal(t, get("streamer").Code, 404)
+
+	_, err := New(nil, usersStub{}, nil, Options{DefaultDeck: "||3;;;Strike;a;Red"})
+	assert.Error(t, err, "invalid default deck: deck is truncated: card index 3 beyond the 1 cards")
+}
+
+// BenchmarkParseCorpus parses every deck of testdata/corpus, reporting allocations so they can be tracked across
+// versions.
+func BenchmarkParseCorpus(b *testing.B) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "corpus", "*.txt"))
+	assert.NilError(b, err)
+	assert.Assert(b, len(paths) > 0)
+
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		assert.NilError(b, err)
+		input := strings.TrimSpace(string(raw))
+
+		b.Run(strings.TrimSuffix(filepath.Base(path), ".txt"), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if _, err := testParser.parseDeck(input); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowParseDoesNotBlockOtherDecks(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	const slowDeck = "||0;;;Slow;a;Red"
+	a.storeDeck("warm", newDeck(smallDeck))
+	a.storeDeck("cold", newDeck(slowDeck))
+	_, err := storedEntry(a, "warm").deck.Bytes(a.parser)
+	assert.NilError(t, err)
+
+	parsing := make(chan struct{})
+	release := make(chan struct{})
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		if raw == slowDeck {
+			close(parsing)
+			<-release
+		}
+	}
+
+	coldDone := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/cold", nil))
+		coldDone <- w.Code
+	}()
+	<-parsing
+
+	warmDone := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/warm", nil))
+		warmDone <- w.Code
+	}()
+	select {
+	case code := <-warmDone:
+		assert.Equal(t, code, 200)
+	case <-time.After(5 * time.Second):
+		t.Fatal("GET of a warm deck blocked on the parse of another deck")
+	}
+
+	close(release)
+	assert.Equal(t, <-coldDone, 200)
+}
+
+func TestParseConcurrencyLimit(t *testing.T) {
+	a := newTestAPI(t, Options{MaxConcurrentParses: 1})
+	const firstDeck = "||0;;;First;a;Red"
+	const secondDeck = "||0;;;Second;a;Red"
+	a.storeDeck("first", newDeck(firstDeck))
+	a.storeDeck("second", newDeck(secondDeck))
+
+	parsing := make(chan string, 2)
+	release := make(chan struct{})
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		parsing <- raw
+		if raw == firstDeck {
+			<-release
+		}
+	}
+
+	get := func(name string) chan int {
+		done := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/"+name, nil))
+			done <- w.Code
+		}()
+		return done
+	}
+	firstDone := get("first")
+	assert.Equal(t, <-parsing, firstDeck)
+	secondDone := get("second")
+
+	// The second parse waits for the first one.
+	select {
+	case raw := <-parsing:
+		t.Fatalf("%q parsed while another parse was running", raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Requests done while waiting give up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/second", nil).WithContext(ctx))
+	assert.Equal(t, w.Code, 503)
+
+	close(release)
+	assert.Equal(t, <-firstDone, 200)
+	assert.Equal(t, <-parsing, secondDeck)
+	assert.Equal(t, <-secondDone, 200)
+}
+
+func TestParseCoalescesIdenticalDecks(t *testing.T) {
+	newTestMeter(t)
+	parsing := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var parses atomic.Int32
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		parses.Add(1)
+		parsing <- struct{}{}
+		<-release
+	}
+
+	// Two pointers to the same contents, as if the deck wasn't interned.
+	first, second := newDeck(smallDeck), newDeck(smallDeck)
+	assert.Assert(t, first != second)
+	parse := func(d *deck) chan error {
+		done := make(chan error)
+		go func() { done <- d.parse(testParser) }()
+		return done
+	}
+	firstDone := parse(first)
+	<-parsing
+	secondDone := parse(second)
+
+	// The second parse joins the first one instead of starting its own.
+	select {
+	case <-parsing:
+		t.Fatal("identical deck parsed while another parse was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NilError(t, <-firstDone)
+	assert.NilError(t, <-secondDone)
+	assert.Equal(t, parses.Load(), int32(1))
+	assert.DeepEqual(t, second.rendered, first.rendered)
+
+	// Parses of other contents aren't shared.
+	assert.NilError(t, newDeck(smallDeck+"x").parse(testParser))
+	assert.Equal(t, parses.Load(), int32(2))
+}
+
+func TestDeckGeneration(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	generation := func() int {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+		assert.Equal(t, w.Code, 200)
+		g, err := strconv.Atoi(w.Header().Get(deckGenerationHeader))
+		assert.NilError(t, err)
+		return g
+	}
+
+	a.storeDeck("streamer", newDeck(smallDeck))
+	first := generation()
+	assert.Equal(t, generation(), first)
+
+	// Storing an identical deck is still a new generation.
+	a.storeDeck("streamer", newDeck(smallDeck))
+	second := generation()
+	assert.Equal(t, second, first+1)
+	assert.Equal(t, generation(), second)
+
+	a.storeDeck("streamer", newDeck("||0;;;Strike;a;Red"))
+	assert.Equal(t, generation(), second+1)
+
+	// Generations keep increasing once the decks are cleared.
+	a.ClearDecks()
+	a.storeDeck("streamer", newDeck(smallDeck))
+	assert.Assert(t, generation() > second+1)
+}
+
+func TestGetDeckByHashHandler(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 200)
+	hash := w.Header().Get(deckHashHeader)
+	assert.Equal(t, len(hash), 2*shortHashSize)
+	assert.Equal(t, get("/deck/streamer").Header().Get(deckHashHeader), hash)
+
+	w = get("/d/" + hash)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+	assert.Equal(t, get("/d/"+strings.ToUpper(hash)).Code, 200)
+
+	// The hash outlives the name it was uploaded under while another name stores the deck.
+	a.storeDeck("other", newDeck(smallDeck))
+	a.storeDeck("streamer", newDeck("||0;;;Strike;a;Red"))
+	assert.Equal(t, get("/d/"+hash).Code, 200)
+
+	a.storeDeck("other", newDeck("||0;;;Strike;a;Red"))
+	assert.Equal(t, get("/d/"+hash).Code, 404)
+	assert.Equal(t, len(a.shortHashes), 1)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	a := newTestAPI(t, Options{StaleWhileRevalidate: true})
+	const slowDeck = "||0;;;Slow;a;Red"
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+		assert.Equal(t, w.Code, 200)
+		return w
+	}
+
+	a.storeDeck("streamer", newDeck(smallDeck))
+	first := get()
+	assert.Equal(t, first.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+
+	parsing := make(chan struct{})
+	release := make(chan struct{})
+	defer func(hook func(string)) { beforeParse = hook }(beforeParse)
+	beforeParse = func(raw string) {
+		if raw == slowDeck {
+			close(parsing)
+			<-release
+		}
+	}
+	a.storeDeck("streamer", newDeck(slowDeck))
+	<-parsing
+
+	// The previous deck is served, with its generation, while the new one parses.
+	stale := get()
+	assert.Equal(t, stale.Body.String(), first.Body.String())
+	assert.Equal(t, stale.Header().Get(deckGenerationHeader), first.Header().Get(deckGenerationHeader))
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for get().Body.String() != "Slow x1\n" {
+		assert.Assert(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Assert(t, get().Header().Get(deckGenerationHeader) != first.Header().Get(deckGenerationHeader))
+}
+
+func TestDeckKeepsRawAfterParse(t *testing.T) {
+	d := newDeck(smallDeck)
+	assert.Assert(t, d.rendered == nil)
+
+	rendered, err := d.Bytes(testParser)
+	assert.NilError(t, err)
+	assert.Equal(t, string(rendered), "card1 x3\ncard2 x2\ncard3 x1\n")
+	assert.Equal(t, d.raw, smallDeck)
+
+	// Parsing again reuses the rendered deck and still leaves raw untouched.
+	again, err := d.Bytes(testParser)
+	assert.NilError(t, err)
+	assert.Equal(t, &again[0], &rendered[0])
+	assert.Equal(t, d.raw, smallDeck)
+}
+
+func TestOversizedDeck(t *testing.T) {
+	a := newTestAPI(t, Options{ExpectedMaxDeckSize: 5})
+	reader := newTestMeter(t)
+
+	// Oversized decks are still served, only reported.
+	body, err := newDeck(smallDeck).Bytes(a.parser)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "card1 x3\ncard2 x2\ncard3 x1\n")
+	assert.Equal(t, counterValue(t, reader, "deck.oversize"), int64(1))
+
+	_, err = newDeck("||0,0;;;Strike;a;Red").Bytes(a.parser)
+	assert.NilError(t, err)
+	assert.Equal(t, counterValue(t, reader, "deck.oversize"), int64(1))
+
+	_, err = newDeck(smallDeck).Bytes(newParser(Options{}))
+	assert.NilError(t, err)
+	assert.Equal(t, counterValue(t, reader, "deck.oversize"), int64(1))
+}
+
+func TestMaxUniqueCards(t *testing.T) {
+	p := newParser(Options{MaxUniqueCards: 2})
+	_, err := p.parseDeck(smallDeck)
+	assert.ErrorIs(t, err, ErrTooManyUniqueCards)
+	assert.Error(t, err, "deck has too many unique cards: more than 2")
+
+	// Card definitions sharing a name are a single unique card.
+	_, err = p.parseDeck("||0,1,2;;;Strike;a;Red;;Strike;b;Red;;Defend;c;Red")
+	assert.NilError(t, err)
+	_, err = newParser(Options{MaxUniqueCards: 2, NameCasing: NameCasingFirstSeen}).
+		parseDeck("||0,1,2;;;Strike;a;Red;;strike;b;Red;;Defend;c;Red")
+	assert.NilError(t, err)
+
+	var deck strings.Builder
+	deck.WriteString("||")
+	for i := 0; i <= defaultMaxUniqueCards; i++ {
+		if i > 0 {
+			deck.WriteString(",")
+		}
+		deck.WriteString(strconv.Itoa(i))
+	}
+	deck.WriteString(";;;")
+	for i := 0; i <= defaultMaxUniqueCards; i++ {
+		if i > 0 {
+			deck.WriteString(";;")
+		}
+		deck.WriteString("Junk" + strconv.Itoa(i) + ";a;Red")
+	}
+	_, err = newDeck(deck.String()).Bytes(testParser)
+	assert.Error(t, err, "deck has too many unique cards: more than 500")
+}
+
+func TestMaxRenderedSize(t *testing.T) {
+	const rendered = "card1 x3\ncard2 x2\ncard3 x1\n"
+	assert.Equal(t, renderedSize(map[string]int{"card1": 3, "card2": 2, "card3": 1}), len(rendered))
+
+	a := newTestAPI(t, Options{MaxRenderedSize: len(rendered) - 1})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck("other", newDeck("||0,0;;;Strike;a;Red"))
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 413)
+	assert.Equal(t, w.Body.String(),
+		`{"error":"rendered deck is too large: 27 bytes, above the 26 bytes limit"}`)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/other", nil))
+	assert.Equal(t, w.Code, 200)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 413)
+
+	a = newTestAPI(t, Options{MaxRenderedSize: len(rendered)})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), rendered)
+}
+
+func TestMaxRenderedSizeFramed(t *testing.T) {
+	const rendered = "Deck\nBash x1\nStrike x2\nZap x1\n"
+	get := func(a *API, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	// The card list alone is within the limit, only the header pushes the deck over it.
+	a := newTestAPI(t, Options{Header: "Deck", MaxRenderedSize: len(rendered) - 1})
+	a.storeDeck("streamer", newDeck(englishDeck))
+	w := get(a, "/deck/streamer")
+	assert.Equal(t, w.Code, 413)
+	assert.Equal(t, w.Body.String(),
+		`{"error":"rendered deck is too large: 30 bytes, above the 29 bytes limit"}`)
+
+	a = newTestAPI(t, Options{Header: "Deck", MaxRenderedSize: len(rendered)})
+	a.storeDeck("streamer", newDeck(englishDeck))
+	w = get(a, "/deck/streamer")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), rendered)
+	assert.Equal(t, get(a, "/deck/streamer?lang=de").Code, 200)
+	// Grouped lines render larger than the stored deck.
+	w = get(a, "/deck/streamer?group=type")
+	assert.Equal(t, w.Code, 413)
+	assert.Equal(t, w.Body.String(),
+		`{"error":"rendered deck is too large: 42 bytes, above the 30 bytes limit"}`)
+}
+
+func newTestTracer(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := o11y.Tracer
+	o11y.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	t.Cleanup(func() { o11y.Tracer = tracer })
+	return recorder
+}
+
+func TestPostEvictDeckHandler(t *testing.T) {
+	a := newTestAPI(t, Options{Admin: true, AdminLogins: []string{"streamer"}})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck("other", newDeck(smallDeck))
+	s := a.streams.subscribe("streamer")
+
+	evict := func(a *API, name string) int {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, newAdminRequest(http.MethodPost, "/admin/deck/"+name+"/evict"))
+		return w.Code
+	}
+
+	assert.Equal(t, evict(a, "Streamer"), 204)
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 404)
+	_, open := <-s.updates
+	assert.Assert(t, !open)
+	// The deck is still stored under the other name.
+	assert.Equal(t, len(a.decks), 1)
+
+	assert.Equal(t, evict(a, "streamer"), 404)
+
+	a = newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	assert.Equal(t, evict(a, "streamer"), 404)
+	assert.Equal(t, storedDeckCount(a), 1)
+}
+
+func TestParseSpanAttributes(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	recorder := newTestTracer(t)
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+		assert.Equal(t, w.Code, 200)
+	}
+
+	spans := recorder.Ended()
+	assert.Equal(t, len(spans), 2)
+	deckAttributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+		attrs := make(map[attribute.Key]string)
+		for _, attr := range span.Attributes() {
+			if strings.HasPrefix(string(attr.Key), "deck.") {
+				attrs[attr.Key] = attr.Value.Emit()
+			}
+		}
+		return attrs
+	}
+	assert.DeepEqual(t, deckAttributes(spans[0]), map[attribute.Key]string{
+		"deck.cold":            "true",
+		"deck.cards.total":     "6",
+		"deck.cards.unique":    "3",
+		"deck.dictionary.size": "2",
+		"deck.substitutions":   "6",
+	})
+	// The deck is warm for the second request.
+	assert.DeepEqual(t, deckAttributes(spans[1]), map[attribute.Key]string{})
+}
+
+func TestClearDecks(t *testing.T) {
+	a := newTestAPI(t, Options{MaxDecks: 1})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck("other", newDeck(smallDeck))
+	assert.Assert(t, a.wasEvicted("streamer"))
+	s := a.streams.subscribe("other")
+
+	a.ClearDecks()
+	assert.Equal(t, storedDeckCount(a), 0)
+	// The streams of the cleared decks end, as they do on eviction.
+	_, open := <-s.updates
+	assert.Assert(t, !open)
+	assert.Equal(t, len(a.decks), 0)
+	assert.Assert(t, !a.wasEvicted("streamer"))
+
+	// Decks stored afterwards aren't shared with the cleared ones.
+	a.storeDeck("streamer", newDeck(smallDeck))
+	assert.Equal(t, storedEntry(a, "streamer").deck.refs, 1)
+}
+
+func TestDeleteDecksHandler(t *testing.T) {
+	a := newTestAPI(t, Options{Admin: true, AdminLogins: []string{"streamer"}})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newAdminRequest(http.MethodDelete, "/decks"))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, storedDeckCount(a), 0)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 404)
+
+	a = newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newAdminRequest(http.MethodDelete, "/decks"))
+	assert.Equal(t, w.Code, 404)
+	assert.Equal(t, storedDeckCount(a), 1)
+}
+
+// newAdminRequest returns a request to an admin endpoint with the credentials of the streamer "streamer".
+func newAdminRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.SetBasicAuth("streamer", "secret")
+	return req
+}
+
+func TestAdminEndpointsAuth(t *testing.T) {
+	a := newTestAPI(t, Options{Admin: true, AdminLogins: []string{"Streamer"}})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	testCases := []struct {
+		desc  string
+		login string
+		code  int
+	}{
+		{desc: "Admin", login: "streamer", code: 200},
+		{desc: "Unknown streamer", login: "other", code: 401},
+		{desc: "No credentials", code: 401},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, req := range []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/stats", nil),
+				httptest.NewRequest(http.MethodPost, "/admin/deck/missing/evict", nil),
+				httptest.NewRequest(http.MethodDelete, "/decks", nil),
+			} {
+				if tc.login != "" {
+					req.SetBasicAuth(tc.login, "secret")
+				}
+				w := httptest.NewRecorder()
+				a.Router.ServeHTTP(w, req)
+				if tc.code == 200 && req.URL.Path == "/admin/deck/missing/evict" {
+					assert.Equal(t, w.Code, 404, req.URL.Path)
+					continue
+				}
+				assert.Equal(t, w.Code, tc.code, req.URL.Path)
+			}
+		})
+	}
+	assert.Equal(t, storedDeckCount(a), 0)
+
+	// Authenticated streamers that aren't admins are forbidden.
+	a = newTestAPI(t, Options{Admin: true, AdminLogins: []string{"other"}})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newAdminRequest(http.MethodDelete, "/decks"))
+	assert.Equal(t, w.Code, 403)
+	assert.Equal(t, storedDeckCount(a), 1)
+}
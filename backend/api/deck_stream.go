@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+// subscriberBuffer is the number of deck updates buffered per subscriber, a subscriber falling further behind is
+// dropped.
+const subscriberBuffer = 8
+
+// deckUpdate is a rendered deck sent to stream subscribers, along with its generation.
+type deckUpdate struct {
+	body       []byte
+	generation uint64
+}
+
+// subscriber receives the rendered decks stored under a name, its updates are closed once it's dropped.
+type subscriber struct {
+	updates chan deckUpdate
+}
+
+// deckHub fans stored decks out to the subscribers of their name without spawning goroutines: every subscriber has a
+// buffered channel published to without blocking, read by the goroutine serving its request.
+type deckHub struct {
+	lock        sync.Mutex
+	subscribers map[string]map[*subscriber]struct{}
+}
+
+func newDeckHub() *deckHub {
+	return &deckHub{subscribers: make(map[string]map[*subscriber]struct{})}
+}
+
+func (h *deckHub) subscribe(name string) *subscriber {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := &subscriber{updates: make(chan deckUpdate, subscriberBuffer)}
+	if h.subscribers[name] == nil {
+		h.subscribers[name] = make(map[*subscriber]struct{})
+	}
+	h.subscribers[name][s] = struct{}{}
+	return s
+}
+
+// unsubscribe removes s from the subscribers of name, if it wasn't dropped already.
+func (h *deckHub) unsubscribe(name string, s *subscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remove(name, s)
+}
+
+// remove drops s, closing its updates. lock must be held.
+func (h *deckHub) remove(name string, s *subscriber) {
+	subscribers := h.subscribers[name]
+	if _, ok := subscribers[s]; !ok {
+		return
+	}
+	delete(subscribers, s)
+	if len(subscribers) == 0 {
+		delete(h.subscribers, name)
+	}
+	close(s.updates)
+}
+
+// drop removes every subscriber of name, ending their streams.
+func (h *deckHub) drop(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for s := range h.subscribers[name] {
+		h.remove(name, s)
+	}
+}
+
+// hasSubscribers reports whether anyone is subscribed to name.
+func (h *deckHub) hasSubscribers(name string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subscribers[name]) > 0
+}
+
+// publish sends update to every subscriber of name, dropping the subscribers whose buffer is full.
+func (h *deckHub) publish(name string, update deckUpdate) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for s := range h.subscribers[name] {
+		select {
+		case s.updates <- update:
+		default:
+			h.remove(name, s)
+		}
+	}
+}
+
+// getDeckStreamHandler streams the rendered deck of a name as server-sent events, the current deck first if there's
+// one, then every deck stored under the name. Events carry the deck generation as their ID, so a client reconnecting
+// with a Last-Event-ID is only sent the decks it hasn't seen.
+func (a *API) getDeckStreamHandler(c *gin.Context) {
+	name := deckKey(c.Param("name"), c.Query("slot"))
+
+	s := a.streams.subscribe(name)
+	defer a.streams.unsubscribe(name, s)
+
+	activeCounter, _ := o11y.Meter.Int64UpDownCounter("deck.subscribers.active")
+	if activeCounter != nil {
+		attrs := metric.WithAttributes(attribute.String("name", a.metricName(c.Param("name"))))
+		activeCounter.Add(c.Request.Context(), 1, attrs)
+		// The request context is done by the time the client disconnected, which would drop the measurement.
+		defer activeCounter.Add(context.Background(), -1, attrs)
+	}
+
+	// seen is the generation of the last deck the client got, an invalid Last-Event-ID counting as none.
+	seen, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+	sendDeck := func(update deckUpdate) {
+		if update.generation <= seen {
+			return
+		}
+		seen = update.generation
+		c.Render(-1, sse.Event{
+			Event: "deck",
+			Id:    strconv.FormatUint(update.generation, 10),
+			Data:  string(update.body),
+		})
+	}
+
+	// Send the headers right away, there might not be a deck to send for a while.
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(200)
+	if e, ok := a.getDeckEntry(name); ok && e.deck.parseContext(c.Request.Context(), a.parser) == nil {
+		if body, err := e.deck.Bytes(a.parser); err == nil {
+			sendDeck(deckUpdate{body: body, generation: e.generation})
+		}
+	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case update, ok := <-s.updates:
+			if !ok {
+				return false
+			}
+			sendDeck(update)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// limitStreams rejects the stream requests of remote IPs having the maximum number of streams open already, so a
+// single client can't hold thousands of connections.
+func (a *API) limitStreams(c *gin.Context) {
+	if a.maxStreamsPerIP == 0 {
+		return
+	}
+	ip := c.ClientIP()
+
+	ok := func() bool {
+		a.streamLock.Lock()
+		defer a.streamLock.Unlock()
+		if a.streamsByIP[ip] >= a.maxStreamsPerIP {
+			return false
+		}
+		a.streamsByIP[ip]++
+		return true
+	}()
+	if !ok {
+		c.AbortWithStatusJSON(429, gin.H{"error": "too many streams"})
+		return
+	}
+	defer func() {
+		a.streamLock.Lock()
+		defer a.streamLock.Unlock()
+		a.streamsByIP[ip]--
+		if a.streamsByIP[ip] == 0 {
+			delete(a.streamsByIP, ip)
+		}
+	}()
+
+	c.Next()
+}
+
+// otherMetricName is the name label of the metrics of names outside the allowlist.
+const otherMetricName = "other"
+
+// metricName returns the name label of name in metrics, names outside the allowlist sharing one label to bound the
+// cardinality.
+func (a *API) metricName(name string) string {
+	name = strings.ToLower(name)
+	if _, ok := a.metricNames[name]; ok {
+		return name
+	}
+	return otherMetricName
+}
+
+// publishDeck sends the deck of e to the stream subscribers of name, if there are any to parse it for. Decks that
+// aren't parsed yet, such as those of messages, are parsed in the background within the parse concurrency limit, so
+// storing them never waits for a parse slot. Subscribers skip the older generations that are published late.
+func (a *API) publishDeck(name string, e *deckEntry) {
+	if !a.streams.hasSubscribers(name) {
+		return
+	}
+	if e.deck.parsed.Load() {
+		a.sendUpdate(name, e)
+		return
+	}
+	go func() {
+		if e.deck.parseContext(context.Background(), a.parser) == nil {
+			a.sendUpdate(name, e)
+		}
+	}()
+}
+
+// sendUpdate publishes the parsed deck of e to the stream subscribers of name.
+func (a *API) sendUpdate(name string, e *deckEntry) {
+	body, err := e.deck.Bytes(a.parser)
+	if err != nil {
+		return
+	}
+	a.streams.publish(name, deckUpdate{body: body, generation: e.generation})
+}
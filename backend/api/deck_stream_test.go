@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+func TestDeckHubDropsSlowSubscriber(t *testing.T) {
+	h := newDeckHub()
+	slow := h.subscribe("streamer")
+	fast := h.subscribe("streamer")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*subscriberBuffer; i++ {
+			h.publish("streamer", deckUpdate{body: []byte{byte(i)}})
+			// The fast subscriber keeps up.
+			assert.Check(t, is.DeepEqual((<-fast.updates).body, []byte{byte(i)}))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on the slow subscriber")
+	}
+
+	// The slow subscriber gets its buffer then is dropped.
+	for i := 0; i < subscriberBuffer; i++ {
+		assert.DeepEqual(t, (<-slow.updates).body, []byte{byte(i)})
+	}
+	_, ok := <-slow.updates
+	assert.Assert(t, !ok)
+
+	h.publish("streamer", deckUpdate{body: []byte("still here")})
+	assert.DeepEqual(t, (<-fast.updates).body, []byte("still here"))
+
+	h.unsubscribe("streamer", slow)
+	h.unsubscribe("streamer", fast)
+	assert.Assert(t, !h.hasSubscribers("streamer"))
+}
+
+func TestGetDeckStreamHandler(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck("||0;;;Strike;a;Red"))
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/deck/streamer/stream", nil)
+	assert.NilError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	lines := bufio.NewScanner(resp.Body)
+	readEvent := func() string {
+		var data []string
+		for lines.Scan() && lines.Text() != "" {
+			if d, ok := strings.CutPrefix(lines.Text(), "data:"); ok {
+				data = append(data, d)
+			}
+		}
+		return strings.Join(data, "\n")
+	}
+
+	assert.Equal(t, readEvent(), "Strike x1\n")
+
+	a.storeDeck("streamer", newDeck("||0,1;;;Strike;a;Red;;Bash;b;Red"))
+	assert.Equal(t, readEvent(), "Bash x1\nStrike x1\n")
+}
+
+func TestPublishDeckParseSlots(t *testing.T) {
+	a := newTestAPI(t, Options{MaxConcurrentParses: 1})
+	s := a.streams.subscribe("streamer")
+
+	// Storing a deck doesn't parse it while every parse slot is taken, it's published once one frees up.
+	a.parser.parseSlots <- struct{}{}
+	d := newDeck("||0;;;Strike;a;Red")
+	a.storeDeck("streamer", d)
+	assert.Assert(t, !d.parsed.Load())
+	select {
+	case <-s.updates:
+		t.Fatal("deck published before it could be parsed")
+	default:
+	}
+
+	<-a.parser.parseSlots
+	select {
+	case update := <-s.updates:
+		assert.Equal(t, string(update.body), "Strike x1\n")
+	case <-time.After(5 * time.Second):
+		t.Fatal("deck not published")
+	}
+}
+
+func TestGetDeckStreamHandlerLastEventID(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck("||0;;;Strike;a;Red"))
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	// connect streams the deck as whoever last saw lastEventID, returning the ID and data of its events.
+	connect := func(lastEventID string) (chan [2]string, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/deck/streamer/stream", nil)
+		assert.NilError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+
+		events := make(chan [2]string)
+		go func() {
+			defer close(events)
+			lines := bufio.NewScanner(resp.Body)
+			var id string
+			var data []string
+			for lines.Scan() {
+				line := lines.Text()
+				if line == "" {
+					events <- [2]string{id, strings.Join(data, "\n")}
+					id, data = "", nil
+				} else if v, ok := strings.CutPrefix(line, "id:"); ok {
+					id = v
+				} else if v, ok := strings.CutPrefix(line, "data:"); ok {
+					data = append(data, v)
+				}
+			}
+		}()
+		return events, func() {
+			cancel()
+			resp.Body.Close()
+		}
+	}
+	next := func(events chan [2]string) [2]string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return [2]string{}
+		}
+	}
+
+	events, disconnect := connect("")
+	first := next(events)
+	assert.Equal(t, first[1], "Strike x1\n")
+	disconnect()
+
+	// Reconnecting with the current generation waits for the next deck.
+	events, disconnect = connect(first[0])
+	defer disconnect()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %q on reconnect", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.storeDeck("streamer", newDeck("||0,1;;;Strike;a;Red;;Bash;b;Red"))
+	second := next(events)
+	assert.Equal(t, second[1], "Bash x1\nStrike x1\n")
+	assert.Assert(t, second[0] != first[0])
+
+	// Reconnecting with an older generation gets the current deck right away.
+	older, disconnectOlder := connect(first[0])
+	defer disconnectOlder()
+	assert.DeepEqual(t, next(older), second)
+}
+
+func TestGetDeckStreamHandlerActiveSubscribers(t *testing.T) {
+	a := newTestAPI(t, Options{MetricNames: []string{"Streamer"}})
+	reader := newTestMeter(t)
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	// subscribe connects to the stream of name, returning a function disconnecting it.
+	subscribe := func(name string) func() {
+		resp, err := http.Get(server.URL + "/deck/" + name + "/stream")
+		assert.NilError(t, err)
+		return func() { resp.Body.Close() }
+	}
+	active := func(name string) int64 {
+		return counterValue(t, reader, "deck.subscribers.active", attribute.String("name", name))
+	}
+	eventually := func(check func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !check() {
+			assert.Assert(t, time.Now().Before(deadline))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	disconnectStreamer := subscribe("streamer")
+	disconnectOther := subscribe("unlisted")
+	eventually(func() bool { return active("streamer") == 1 && active("other") == 1 })
+	assert.Equal(t, counterValue(t, reader, "deck.subscribers.active"), int64(2))
+
+	disconnectStreamer()
+	eventually(func() bool { return active("streamer") == 0 })
+	assert.Equal(t, active("other"), int64(1))
+
+	disconnectOther()
+	eventually(func() bool { return counterValue(t, reader, "deck.subscribers.active") == 0 })
+}
+
+func TestGetDeckStreamHandlerMaxStreamsPerIP(t *testing.T) {
+	a := newTestAPI(t, Options{MaxStreamsPerIP: 2})
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	connect := func() *http.Response {
+		resp, err := http.Get(server.URL + "/deck/streamer/stream")
+		assert.NilError(t, err)
+		return resp
+	}
+
+	first, second := connect(), connect()
+	defer second.Body.Close()
+	assert.Equal(t, first.StatusCode, 200)
+	assert.Equal(t, second.StatusCode, 200)
+
+	overflow := connect()
+	overflow.Body.Close()
+	assert.Equal(t, overflow.StatusCode, 429)
+
+	// Disconnecting frees a stream for the IP.
+	first.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := connect()
+		resp.Body.Close()
+		if resp.StatusCode == 200 {
+			break
+		}
+		assert.Equal(t, resp.StatusCode, 429)
+		assert.Assert(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
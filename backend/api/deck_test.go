@@ -1,13 +1,32 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/ugorji/go/codec"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/exp/slog"
 	"gotest.tools/v3/assert"
+
+	errors2 "github.com/MaT1g3R/slaytherelics/errors"
+	"github.com/MaT1g3R/slaytherelics/models"
+	"github.com/MaT1g3R/slaytherelics/o11y"
 )
 
+var testParser = newParser(Options{})
+
 func TestDecompress(t *testing.T) {
 	testCases := []struct {
 		desc        string
@@ -69,17 +88,50 @@ func TestDecompress(t *testing.T) {
 			output:      "BBB&1CCC",
 			shouldError: false,
 		},
+		{
+			desc:        "Empty body",
+			input:       "a|b|c||",
+			output:      "",
+			shouldError: false,
+		},
 		{
 			desc:        "Small Deck",
 			input:       "card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z",
 			output:      "0,1,1,0,2,0;;;card1;junk;x;;card2;junk;y;;card3;junk;z",
 			shouldError: false,
 		},
+		{
+			desc:        "Too many dictionary entries fails",
+			input:       strings.Repeat("a|", len(WILDCARDS)) + "a||&0",
+			output:      "",
+			shouldError: true,
+		},
+		{
+			desc:        "Longest dictionary entry",
+			input:       strings.Repeat("a", defaultMaxDictEntryLength) + "||&0",
+			output:      strings.Repeat("a", defaultMaxDictEntryLength),
+			shouldError: false,
+		},
+		{
+			desc:        "Oversized dictionary entry fails",
+			input:       "Strike|" + strings.Repeat("a", defaultMaxDictEntryLength+1) + "||&0",
+			output:      "",
+			shouldError: true,
+		},
+		{
+			desc:        "Decompression bomb fails",
+			input:       getBombString(40),
+			output:      "",
+			shouldError: true,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			actualOutput, err := decompress(tc.input)
+			actualOutput, err := testParser.decompress(tc.input)
+			bytesOutput, bytesErr := testParser.decompressBytes([]byte(tc.input))
+			assert.Equal(t, string(bytesOutput), actualOutput)
+			assert.Equal(t, bytesErr == nil, err == nil)
 			if tc.shouldError {
 				assert.Equal(t, true, err != nil)
 				return
@@ -91,6 +143,96 @@ func TestDecompress(t *testing.T) {
 	}
 }
 
+func TestDecompressMaxDictEntryLength(t *testing.T) {
+	p := newParser(Options{MaxDictEntryLength: 6})
+
+	output, err := p.decompress("Strike|Defend||&0 &1")
+	assert.NilError(t, err)
+	assert.Equal(t, output, "Strike Defend")
+
+	_, err = p.decompress("Strike|Defend|Ascender's Bane||&0 &1 &2")
+	assert.Error(t, err, "compression dictionary entry 2 is longer than 6 bytes")
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	input := getBigDeckString()
+
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = testParser.decompress(input)
+		}
+	})
+	b.Run("Bytes", func(b *testing.B) {
+		raw := []byte(input)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = testParser.decompressBytes(raw)
+		}
+	})
+}
+
+// getBombString makes a compressed string whose dictionary entries each double the previous one.
+func getBombString(depth int) string {
+	compressionDict := []string{"boom"}
+	for i := 1; i < depth; i++ {
+		compressionDict = append(compressionDict, fmt.Sprintf("&%c&%c", WILDCARDS[i-1], WILDCARDS[i-1]))
+	}
+	return fmt.Sprintf("%s||&%c", strings.Join(compressionDict, "|"), WILDCARDS[depth-1])
+}
+
+func TestDecompressStrict(t *testing.T) {
+	strict := newParser(Options{Strict: true})
+
+	testCases := []struct {
+		desc  string
+		input string
+		err   string
+	}{
+		{
+			desc:  "Unused compression",
+			input: "Foo|Bar||I love love slay the relics and slay the spire",
+			err:   "compression dictionary entry 0 is never used",
+		},
+		{
+			desc:  "Partially unused compression",
+			input: "love|slay the|spire||I &0 &0 &1 relics and &1 spire",
+			err:   "compression dictionary entry 2 is never used",
+		},
+		{
+			desc:  "Nested compression",
+			input: "love|the|slay &1||I &0 &0 &2 relics and &2 spire",
+			err:   "",
+		},
+		{
+			desc:  "No compression",
+			input: "||I love love slay the relics and slay the spire",
+			err:   "",
+		},
+		{
+			desc:  "Empty body",
+			input: "a|b|c||",
+			err:   "deck is empty",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := testParser.decompress(tc.input)
+			assert.NilError(t, err)
+
+			_, err = strict.decompress(tc.input)
+			_, bytesErr := strict.decompressBytes([]byte(tc.input))
+			assert.Equal(t, fmt.Sprint(bytesErr), fmt.Sprint(err))
+			if tc.err == "" {
+				assert.NilError(t, err)
+			} else {
+				assert.Error(t, err, tc.err)
+			}
+		})
+	}
+}
+
 func TestParseCommaDelimitedIntegerArray(t *testing.T) {
 	testCases := []struct {
 		desc        string
@@ -132,7 +274,7 @@ func TestParseCommaDelimitedIntegerArray(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			actualOutput, err := parseCommaDelimitedIntegerArray(tc.input)
+			actualOutput, err := testParser.parseCommaDelimitedIntegerArray(tc.input)
 			if tc.shouldError {
 				assert.Equal(t, true, err != nil)
 				return
@@ -147,6 +289,84 @@ func TestParseCommaDelimitedIntegerArray(t *testing.T) {
 	}
 }
 
+func TestParseCommaDelimitedIntegerArrayMaxIndices(t *testing.T) {
+	p := newParser(Options{MaxIndices: 3})
+
+	output, err := p.parseCommaDelimitedIntegerArray("1,2,3")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, []int{1, 2, 3})
+
+	// The junk after the limit is never parsed, the limit is hit first.
+	_, err = p.parseCommaDelimitedIntegerArray("1,2,3,4,junk")
+	assert.Error(t, err, "deck has more than 3 card indices")
+
+	_, err = testParser.decompressDeck("||" + strings.Repeat("0,", defaultMaxIndices) + "0;;;card;a;b")
+	assert.Error(t, err, "deck has more than 2000 card indices")
+}
+
+func TestParseCommaDelimitedIntegerArrayBoundedAllocation(t *testing.T) {
+	result := testing.Benchmark(BenchmarkParseCommaDelimitedIntegerArrayHuge)
+	// Preallocating for every comma would take 32MiB, the preallocation must be capped at maxIndices instead.
+	assert.Assert(t, result.AllocedBytesPerOp() < 64<<10, "allocated %d bytes per parse", result.AllocedBytesPerOp())
+}
+
+func BenchmarkParseCommaDelimitedIntegerArrayHuge(b *testing.B) {
+	input := strings.Repeat("1,", 4<<20) + "1"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = testParser.parseCommaDelimitedIntegerArray(input)
+	}
+}
+
+func TestDecompressRejectMissingWildcards(t *testing.T) {
+	p := newParser(Options{RejectMissingWildcards: true})
+
+	testCases := []struct {
+		desc   string
+		input  string
+		output string
+		err    string
+	}{
+		{
+			desc:   "Every wildcard exists",
+			input:  "Strike|Defend|Bash||&0 &1 &2",
+			output: "Strike Defend Bash",
+		},
+		{
+			desc:  "Wildcard past the dictionary",
+			input: "Strike|Defend|Bash||&0 &1 &5",
+			err:   "body references missing dictionary entry &5",
+		},
+		{
+			desc:  "Wildcard introduced by an entry",
+			input: "Strike &a|Defend||&0 &1",
+			err:   "body references missing dictionary entry &a",
+		},
+		{
+			desc:   "Ampersands that aren't wildcards",
+			input:  "Strike||&0 & Dark &&",
+			output: "Strike & Dark &&",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			// The dictionary mismatch otherwise goes unnoticed.
+			_, err := testParser.decompress(tc.input)
+			assert.NilError(t, err)
+
+			output, err := p.decompress(tc.input)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, output, tc.output)
+		})
+	}
+}
+
 func TestDecompressDeck(t *testing.T) {
 	testCases := []struct {
 		desc        string
@@ -178,6 +398,12 @@ func TestDecompressDeck(t *testing.T) {
 			output:      map[string]int{},
 			shouldError: true,
 		},
+		{
+			desc:        "Missing card list",
+			input:       "card|junk||0,1,1,0,2,0",
+			output:      map[string]int{},
+			shouldError: true,
+		},
 		{
 			desc:  "Simple deck",
 			input: "card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z",
@@ -192,7 +418,7 @@ func TestDecompressDeck(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			actualOutput, err := decompressDeck(tc.input)
+			actualOutput, err := testParser.decompressDeck(tc.input)
 			if tc.shouldError {
 				assert.Equal(t, true, err != nil)
 				return
@@ -207,70 +433,1238 @@ func TestDecompressDeck(t *testing.T) {
 	}
 }
 
-// getBigDeckString makes us a 52 card compressed deck string for testing with.
-func getBigDeckString() string {
-	compressionDict := make([]string, 0, 128)
+func TestDecompressDeckEmptyCardList(t *testing.T) {
+	for _, input := range []string{"||0,1,2;;;", "||0,1,2;;;-"} {
+		_, err := testParser.decompressDeck(input)
+		assert.Error(t, err, "deck references cards but card list is empty", input)
+	}
+}
 
-	// Generate cards.
-	compressedCards := make([]string, 0, 52)
-	for i := 0; i < 52; i++ {
-		compressionDict = append(compressionDict, fmt.Sprintf("Card Name %d;other details;junk", i))
-		compressedCards = append(compressionDict, fmt.Sprintf("%c", WILDCARDS[i]))
+func TestDecompressDeckEmptySlots(t *testing.T) {
+	const input = "||0,-1,1,-1;;;Strike;a;Red;;Defend;b;Red"
+
+	_, err := testParser.decompressDeck(input)
+	assert.Error(t, err, "card index out of bounds")
+
+	p := newParser(Options{SkipEmptySlots: true})
+	output, err := p.decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 1, "Defend": 1})
+
+	_, err = p.decompressDeck("||0,-2,1;;;Strike;a;Red;;Defend;b;Red")
+	assert.Error(t, err, "card index out of bounds")
+
+	sentinel := -2
+	p = newParser(Options{SkipEmptySlots: true, EmptySlotSentinel: &sentinel})
+	output, err = p.decompressDeck("||0,-2,1;;;Strike;a;Red;;Defend;b;Red")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 1, "Defend": 1})
+	_, err = p.decompressDeck(input)
+	assert.Error(t, err, "card index out of bounds")
+}
+
+func TestDecompressCompressionRatio(t *testing.T) {
+	reader := newTestMeter(t)
+
+	_, err := testParser.decompressDeck("Strike;a;Red||0,0;;;&0;;;&0")
+	assert.NilError(t, err)
+	assert.Equal(t, histogramCount(t, reader, "deck.compression.ratio"), uint64(1))
+
+	_, err = testParser.decompressDeck("invalid")
+	assert.ErrorContains(t, err, "invalid deck")
+	assert.Equal(t, histogramCount(t, reader, "deck.compression.ratio"), uint64(1))
+}
+
+func TestDecompressSubstitutions(t *testing.T) {
+	reader := newTestMeter(t)
+	const body = "0,0,1;;;&0;&1;&2;;Bash;&1;&2"
+
+	_, substitutions, err := testParser.expand([]byte("Strike|Deal 6 damage.|Red||" + body))
+	assert.NilError(t, err)
+	assert.Equal(t, substitutions, strings.Count(body, "&"))
+
+	// Wildcards introduced by an expansion are counted too.
+	_, substitutions, err = testParser.expand([]byte("Strike|&0 Strike||&1"))
+	assert.NilError(t, err)
+	assert.Equal(t, substitutions, 2)
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+	var sum int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if hist, ok := m.Data.(metricdata.Histogram[int64]); ok && m.Name == "deck.substitutions" {
+				for _, dp := range hist.DataPoints {
+					sum += dp.Sum
+				}
+			}
+		}
 	}
-	cardsPart := strings.Join(compressedCards, ";;")
+	assert.Equal(t, sum, int64(7))
+}
 
-	// Generate deck.
-	deckIndices := make([]string, 0, 100)
-	for i := 0; i < 52; i++ {
-		deckIndices = append(deckIndices, fmt.Sprintf("%d", i))
+func TestDecompressDeckInvalidUTF8(t *testing.T) {
+	// The name of the second card is cut in the middle of the two bytes of "é".
+	const input = "||0,1;;;Strike;a;Red;;Cl\xc3;b;Red"
+
+	output, err := testParser.decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 1, "Cl\xc3": 1})
+
+	_, err = newParser(Options{InvalidUTF8: InvalidUTF8Reject}).decompressDeck(input)
+	assert.Error(t, err, "name of card 1 is not valid UTF-8")
+
+	output, err = newParser(Options{InvalidUTF8: InvalidUTF8Replace}).decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 1, "Cl\uFFFD": 1})
+}
+
+func TestForEachDelimited(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		input  string
+		stop   string
+		tokens []string
+	}{
+		{
+			desc:   "Every token",
+			input:  "0,1,,2",
+			tokens: []string{"0", "1", "", "2"},
+		},
+		{
+			desc:   "Empty input",
+			input:  "",
+			tokens: []string{""},
+		},
+		{
+			desc:   "Early stop",
+			input:  "0,1,2,3",
+			stop:   "1",
+			tokens: []string{"0", "1"},
+		},
+		{
+			desc:   "Stop at the last token",
+			input:  "0,1",
+			stop:   "1",
+			tokens: []string{"0", "1"},
+		},
 	}
-	for i := 0; i < 48; i++ {
-		deckIndices = append(deckIndices, "17")
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var tokens []string
+			count := forEachDelimited(tc.input, ",", func(token string) bool {
+				tokens = append(tokens, token)
+				return tc.stop == "" || token != tc.stop
+			})
+			assert.DeepEqual(t, tokens, tc.tokens)
+			assert.Equal(t, count, len(tc.tokens))
+		})
 	}
-	deckPart := strings.Join(deckIndices, ",")
+}
 
-	// Put it all together.
-	compressionPart := strings.Join(compressionDict, "|")
-	compressedPart := fmt.Sprintf("%s;;;%s", deckPart, cardsPart)
-	return fmt.Sprintf("%s||%s", compressionPart, compressedPart)
+func TestDecompressDeckIndexBase(t *testing.T) {
+	const cards = ";;;Strike;a;Red;;Defend;b;Red;;Bash;c;Red"
+
+	zeroBased, err := testParser.decompressDeck("||0,0,1,2" + cards)
+	assert.NilError(t, err)
+	p := newParser(Options{IndexBase: 1})
+	oneBased, err := p.decompressDeck("||1,1,2,3" + cards)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, oneBased, zeroBased)
+	assert.DeepEqual(t, oneBased, map[string]int{"Strike": 2, "Defend": 1, "Bash": 1})
+
+	_, err = p.decompressDeck("||1,4" + cards)
+	assert.Error(t, err, "deck is truncated: card index 4 beyond the 3 cards")
+	_, err = p.decompressDeck("||0,1" + cards)
+	assert.Error(t, err, "card index out of bounds")
+
+	p = newParser(Options{IndexBase: 1, SkipEmptySlots: true})
+	output, err := p.decompressDeck("||1,-1,3" + cards)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 1, "Bash": 1})
+
+	// 1-based mods can mark empty slots with 0, which is no card's index.
+	sentinel := 0
+	opts := Options{IndexBase: 1, SkipEmptySlots: true, EmptySlotSentinel: &sentinel}
+	assert.NilError(t, opts.validate())
+	p = newParser(opts)
+	output, err = p.decompressDeck("||1,0,3,0" + cards)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 1, "Bash": 1})
+	_, err = p.decompressDeck("||1,-1,3" + cards)
+	assert.Error(t, err, "card index out of bounds")
 }
 
-func TestDecompressBigDeck(t *testing.T) {
-	output, err := decompressDeck(getBigDeckString())
+func TestDecompressDeckUniqueIndices(t *testing.T) {
+	const input = "||0,0,1,2,2,2;;;Strike;a;Red;;Defend;b;Red;;Bash;c;Red"
+
+	multiset, err := testParser.decompressDeck(input)
 	assert.NilError(t, err)
+	assert.DeepEqual(t, multiset, map[string]int{"Strike": 2, "Defend": 1, "Bash": 3})
 
-	assert.Equal(t, len(output), 52)
-	for card, count := range output {
-		switch card {
-		case "Card Name 17":
-			assert.Equal(t, count, 49, card)
-		default:
-			assert.Equal(t, count, 1, card)
-		}
-	}
+	p := newParser(Options{UniqueIndices: true})
+	set, err := p.decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, set, map[string]int{"Strike": 1, "Defend": 1, "Bash": 1})
+
+	// Distinct instances of the same card are still counted together.
+	set, err = p.decompressDeck("||0,1,1,2;;;Strike;a;Red;;Strike;a;Red;;Bash;c;Red")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, set, map[string]int{"Strike": 2, "Bash": 1})
 }
 
-func BenchmarkDecompressDeck(b *testing.B) {
+func TestDecompressDeckTruncated(t *testing.T) {
 	testCases := []struct {
 		desc  string
 		input string
+		err   string
 	}{
 		{
-			desc:  "Simple deck",
-			input: "card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z",
+			desc:  "Dangling index",
+			input: "||0,1,;;;Strike;a;Red;;Bash;b;Red",
+			err:   "deck is truncated: card indices end with a separator",
 		},
 		{
-			desc:  "Big deck",
-			input: getBigDeckString(),
+			desc:  "Dangling card",
+			input: "||0,1;;;Strike;a;Red;;",
+			err:   "deck is truncated: card list ends with a separator",
+		},
+		{
+			desc:  "Index beyond the card list",
+			input: "||0,1,2;;;Strike;a;Red;;Bash;b;Re",
+			err:   "deck is truncated: card index 2 beyond the 2 cards",
 		},
 	}
 
-	b.ResetTimer()
 	for _, tc := range testCases {
-		b.Run(tc.desc, func(b *testing.B) {
-			for i := 0; i < b.N; i++ {
-				decompressDeck(tc.input)
-			}
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := testParser.decompressDeck(tc.input)
+			assert.ErrorIs(t, err, ErrTruncatedDeck)
+			assert.Error(t, err, tc.err)
+		})
+	}
+
+	_, err := testParser.decompressDeck("||0,-1;;;Strike;a;Red")
+	assert.Error(t, err, "card index out of bounds")
+	assert.Assert(t, !errors.Is(err, ErrTruncatedDeck))
+}
+
+func TestDecompressDeckNoCardsSection(t *testing.T) {
+	const input = "a||0,1,2"
+
+	_, err := testParser.decompressDeck(input)
+	assert.Error(t, err, "deck has no card definitions")
+
+	_, err = newDeck(input).Bytes(testParser)
+	assert.Error(t, err, "deck has no card definitions")
+}
+
+func TestDecompressDeckWrongSectionSeparator(t *testing.T) {
+	_, err := testParser.decompressDeck("||0,1;;Strike;a;Red;;Defend;b;Red")
+	assert.Error(t, err, `deck has no card definitions: no ";;;" section separator but found ";;", `+
+		"likely the wrong separator")
+}
+
+func TestDecompressDeckCustomFormat(t *testing.T) {
+	p := newParser(Options{Format: Format{
+		DictSeparator:    "~~",
+		WordSeparator:    "~",
+		SectionSeparator: "###",
+		CardSeparator:    "##",
+	}})
+
+	output, err := p.decompressDeck("card~junk~~0,1,1,0,2,0###&01;&1;x##&02;&1;y##&03;&1;z")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{
+		"card1": 3,
+		"card2": 2,
+		"card3": 1,
+	})
+
+	_, err = p.decompressDeck("card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z")
+	assert.Error(t, err, "invalid deck")
+}
+
+func TestDecompressDeckCRLF(t *testing.T) {
+	const input = "Strike|Red\r\n||0,0,1\r\n;;;&0\r;a;&1;;Bash;b;&1\r\n"
+
+	p := newParser(Options{StripCR: true})
+	output, err := p.decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 2, "Bash": 1})
+
+	// The same deck without carriage returns is counted identically.
+	output, err = p.decompressDeck(strings.ReplaceAll(input, "\r", ""))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike": 2, "Bash": 1})
+
+	// Otherwise the carriage returns end up in the card names.
+	output, err = testParser.decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"Strike\r": 2, "Bash": 1})
+}
+
+func TestDecompressDeckDetailed(t *testing.T) {
+	// Strike;a;x is defined twice at different indices.
+	input := "||0,1,2,2,3;;;Strike;a;x;;Defend;b;y;;Strike;a;x;;Strike;c;z;;Unused;d;w"
+
+	details, err := testParser.decompressDeckDetailed(input, detailOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, details, []cardDetail{
+		{Name: "Strike", Description: "a", Type: "x", Count: 1, BaseName: "Strike"},
+		{Name: "Defend", Description: "b", Type: "y", Count: 1, BaseName: "Defend"},
+		{Name: "Strike", Description: "a", Type: "x", Count: 2, BaseName: "Strike"},
+		{Name: "Strike", Description: "c", Type: "z", Count: 1, BaseName: "Strike"},
+	})
+
+	details, err = testParser.decompressDeckDetailed(input, detailOptions{mergeIdentical: true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, details, []cardDetail{
+		{Name: "Strike", Description: "a", Type: "x", Count: 3, BaseName: "Strike"},
+		{Name: "Defend", Description: "b", Type: "y", Count: 1, BaseName: "Defend"},
+		{Name: "Strike", Description: "c", Type: "z", Count: 1, BaseName: "Strike"},
+	})
+
+}
+
+func TestDecompressDeckCardNames(t *testing.T) {
+	// Strike_R and Strike_G are distinct raw names remapped to the same card.
+	const input = "||0,1,1,2;;;Strike_R;a;Attack;;Strike_G;a;Attack;;Defend_R;b;Skill"
+	p := newParser(Options{CardNames: map[string]string{"Strike_R": "Strike", "Strike_G": "Strike"}})
+
+	counts, err := p.decompressDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, counts, map[string]int{"Strike": 3, "Defend_R": 1})
+
+	d, cards, err := p.splitDeck(input)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, p.countCards(d, cards, []string{"strike"}), map[string]int{"Defend_R": 1})
+	assert.DeepEqual(t, p.countCardsByType(d, cards, []string{"Strike"}),
+		map[string]map[string]int{"Skill": {"Defend_R": 1}})
+
+	details, err := p.decompressDeckDetailed(input, detailOptions{mergeIdentical: true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, details, []cardDetail{
+		{Name: "Strike", Description: "a", Type: "Attack", Count: 3, BaseName: "Strike"},
+		{Name: "Defend_R", Description: "b", Type: "Skill", Count: 1, BaseName: "Defend_R"},
+	})
+}
+
+func TestDecompressDeckDetailedFewerFields(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		input   string
+		details []cardDetail
+	}{
+		{
+			desc:  "One field",
+			input: "||0,0,1;;;Strike;;Bash",
+			details: []cardDetail{
+				{Name: "Strike", Count: 2, BaseName: "Strike"},
+				{Name: "Bash", Count: 1, BaseName: "Bash"},
+			},
+		},
+		{
+			desc:  "Two fields",
+			input: "||0,0,1;;;Strike;Deal 6 damage.;;Bash;Deal 8 damage.",
+			details: []cardDetail{
+				{Name: "Strike", Description: "Deal 6 damage.", Count: 2, BaseName: "Strike"},
+				{Name: "Bash", Description: "Deal 8 damage.", Count: 1, BaseName: "Bash"},
+			},
+		},
+		{
+			desc:  "Three fields",
+			input: "||0,0,1;;;Strike;Deal 6 damage.;Red;;Bash;Deal 8 damage.;Red",
+			details: []cardDetail{
+				{Name: "Strike", Description: "Deal 6 damage.", Type: "Red", Count: 2, BaseName: "Strike"},
+				{Name: "Bash", Description: "Deal 8 damage.", Type: "Red", Count: 1, BaseName: "Bash"},
+			},
+		},
+		{
+			desc:  "Mixed fields",
+			input: "||0,1,2,2;;;Strike;a;Red;;Bash;b;;Anger",
+			details: []cardDetail{
+				{Name: "Strike", Description: "a", Type: "Red", Count: 1, BaseName: "Strike"},
+				{Name: "Bash", Description: "b", Count: 1, BaseName: "Bash"},
+				{Name: "Anger", Count: 2, BaseName: "Anger"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			details, err := testParser.decompressDeckDetailed(tc.input, detailOptions{mergeIdentical: true})
+			assert.NilError(t, err)
+			assert.DeepEqual(t, details, tc.details)
+		})
+	}
+}
+
+func TestRenderDeckDeterministic(t *testing.T) {
+	// Strike is defined at two different indices and collapses into a single name.
+	input := "||0,1,2,3,3,1;;;Strike;a;x;;Defend;b;y;;Strike;c;z;;Ascender's Bane;d;w"
+
+	d, err := testParser.decompressDeck(input)
+	assert.NilError(t, err)
+	expected := testParser.renderDeck(d)
+	assert.Equal(t, string(expected), "Defend x2\nStrike x2\nAscender's Bane x2\n")
+
+	for i := 0; i < 100; i++ {
+		d, err := testParser.decompressDeck(input)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, testParser.renderDeck(d), expected)
+	}
+}
+
+func TestRenderDeckPins(t *testing.T) {
+	d := map[string]int{"Strike": 1, "Ascender's Bane": 1, "Defend": 1, "Wound": 1, "Bash": 1}
+
+	testCases := []struct {
+		desc   string
+		opts   Options
+		output string
+	}{
+		{
+			desc:   "Default pins",
+			opts:   Options{},
+			output: "Bash x1\nDefend x1\nStrike x1\nWound x1\nAscender's Bane x1\n",
+		},
+		{
+			desc:   "No default pins",
+			opts:   Options{NoDefaultPins: true},
+			output: "Ascender's Bane x1\nBash x1\nDefend x1\nStrike x1\nWound x1\n",
+		},
+		{
+			desc:   "Pinned cards",
+			opts:   Options{PinnedCards: []string{"Wound", "Bash"}},
+			output: "Defend x1\nStrike x1\nAscender's Bane x1\nWound x1\nBash x1\n",
+		},
+		{
+			desc:   "Only pinned cards",
+			opts:   Options{PinnedCards: []string{"Wound"}, NoDefaultPins: true},
+			output: "Ascender's Bane x1\nBash x1\nDefend x1\nStrike x1\nWound x1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, string(newParser(tc.opts).renderDeck(d)), tc.output)
+		})
+	}
+}
+
+func FuzzDecompressDeck(f *testing.F) {
+	f.Add(getBigDeckString())
+	f.Fuzz(func(t *testing.T, input string) {
+		// Only errors are acceptable for malformed input, never panics.
+		_, _ = testParser.decompressDeck(input)
+	})
+}
+
+// getBigDeckString makes us a 52 card compressed deck string for testing with.
+func getBigDeckString() string {
+	compressionDict := make([]string, 0, 128)
+
+	// Generate cards.
+	compressedCards := make([]string, 0, 52)
+	for i := 0; i < 52; i++ {
+		compressionDict = append(compressionDict, fmt.Sprintf("Card Name %d;other details;junk", i))
+		compressedCards = append(compressionDict, fmt.Sprintf("%c", WILDCARDS[i]))
+	}
+	cardsPart := strings.Join(compressedCards, ";;")
+
+	// Generate deck.
+	deckIndices := make([]string, 0, 100)
+	for i := 0; i < 52; i++ {
+		deckIndices = append(deckIndices, fmt.Sprintf("%d", i))
+	}
+	for i := 0; i < 48; i++ {
+		deckIndices = append(deckIndices, "17")
+	}
+	deckPart := strings.Join(deckIndices, ",")
+
+	// Put it all together.
+	compressionPart := strings.Join(compressionDict, "|")
+	compressedPart := fmt.Sprintf("%s;;;%s", deckPart, cardsPart)
+	return fmt.Sprintf("%s||%s", compressionPart, compressedPart)
+}
+
+func TestDecompressBigDeck(t *testing.T) {
+	output, err := testParser.decompressDeck(getBigDeckString())
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(output), 52)
+	for card, count := range output {
+		switch card {
+		case "Card Name 17":
+			assert.Equal(t, count, 49, card)
+		default:
+			assert.Equal(t, count, 1, card)
+		}
+	}
+}
+
+func BenchmarkDecompressDeck(b *testing.B) {
+	testCases := []struct {
+		desc  string
+		input string
+	}{
+		{
+			desc:  "Simple deck",
+			input: "card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z",
+		},
+		{
+			desc:  "Big deck",
+			input: getBigDeckString(),
+		},
+	}
+
+	b.ResetTimer()
+	for _, tc := range testCases {
+		b.Run(tc.desc, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				testParser.decompressDeck(tc.input)
+			}
+		})
+	}
+}
+
+// usersStub authenticates the streamer "streamer" with the secret "secret".
+type usersStub struct{}
+
+func (usersStub) AuthenticateTwitch(ctx context.Context, code string) (models.User, string, error) {
+	return models.User{}, "", &errors2.AuthError{Err: errors.New("unsupported")}
+}
+
+func (usersStub) AuthenticateRedis(ctx context.Context, userID, token string) (models.User, error) {
+	if userID != "streamer" || token != "secret" {
+		return models.User{}, &errors2.AuthError{Err: errors.New("unauthorized")}
+	}
+	return models.User{Login: "Streamer", ID: "streamer"}, nil
+}
+
+func (usersStub) UserAuth(ctx context.Context, login string, secret string) (bool, error) {
+	return login == "streamer" && secret == "secret", nil
+}
+
+func (usersStub) GetUserID(ctx context.Context, login string) (string, error) {
+	return login, nil
+}
+
+// newTestMeter replaces o11y.Meter for the duration of the test, returning a reader of the recorded metrics.
+func newTestMeter(t *testing.T) *sdkmetric.ManualReader {
+	reader := sdkmetric.NewManualReader()
+	meter := o11y.Meter
+	o11y.Meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	t.Cleanup(func() { o11y.Meter = meter })
+	return reader
+}
+
+// histogramCount returns the number of values recorded by the float histogram name.
+func histogramCount(t *testing.T, reader *sdkmetric.ManualReader, name string) uint64 {
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+
+	var count uint64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if hist, ok := m.Data.(metricdata.Histogram[float64]); ok && m.Name == name {
+				for _, dp := range hist.DataPoints {
+					count += dp.Count
+				}
+			}
+		}
+	}
+	return count
+}
+
+// counterValue sums the data points of the counter name having all of attrs.
+func counterValue(t *testing.T, reader *sdkmetric.ManualReader, name string, attrs ...attribute.KeyValue) int64 {
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if m.Name != name || !ok {
+				continue
+			}
+			for _, dp := range sum.DataPoints {
+				matches := true
+				for _, attr := range attrs {
+					v, ok := dp.Attributes.Value(attr.Key)
+					matches = matches && ok && v == attr.Value
+				}
+				if matches {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+func newTestAPI(t *testing.T, opts Options) *API {
+	cancel := o11y.Init("test")
+	t.Cleanup(func() { cancel(context.Background()) })
+
+	a, err := New(nil, usersStub{}, nil, opts)
+	assert.NilError(t, err)
+	return a
+}
+
+func TestGetDeckHandlerHead(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck("card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z"))
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+	etag := w.Header().Get("ETag")
+	assert.Assert(t, etag != "")
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("ETag"), etag)
+	assert.Equal(t, w.Body.Len(), 0)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodHead, "/deck/streamer", nil)
+	req.Header.Set("If-None-Match", etag)
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 304)
+	assert.Equal(t, w.Body.Len(), 0)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/deck/missing", nil))
+	assert.Equal(t, w.Code, 404)
+	assert.Equal(t, w.Body.Len(), 0)
+}
+
+func TestGetDeckHandlerETagHash(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		hash  ETagHash
+		etag  string
+		other string
+	}{
+		{
+			desc:  "FNV",
+			hash:  ETagHashFNV,
+			etag:  `"8bb2ad6ddf9319f7"`,
+			other: `"fa896906fd2e4fe0"`,
+		},
+		{
+			desc:  "SHA-256",
+			hash:  ETagHashSHA256,
+			etag:  `"f16d9292ee1688ee0f40932540faade16816ef2f9a7565b3a54517d57c97e28f"`,
+			other: `"4fc693d952dce9ae8bff8294e81d4e1ac174121a20e5930ace7aed1ccba983ac"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, Options{ETagHash: tc.hash})
+			etag := func() string {
+				w := httptest.NewRecorder()
+				a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+				assert.Equal(t, w.Code, 200)
+				return w.Header().Get("ETag")
+			}
+
+			// The ETag only depends on the rendered deck, not on when or how many times it was stored.
+			a.storeDeck("streamer", newDeck(smallDeck))
+			assert.Equal(t, etag(), tc.etag)
+			a.storeDeck("streamer", newDeck(smallDeck))
+			assert.Equal(t, etag(), tc.etag)
+
+			a.storeDeck("streamer", newDeck("||0;;;Strike;a;Red"))
+			assert.Equal(t, etag(), tc.other)
+		})
+	}
+}
+
+func TestGetDeckHandlerParseError(t *testing.T) {
+	defer func(l *slog.Logger) { o11y.Logger = l }(o11y.Logger)
+
+	for _, devMode := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DevMode=%t", devMode), func(t *testing.T) {
+			logs := &bytes.Buffer{}
+			o11y.Logger = slog.New(slog.NewTextHandler(logs))
+
+			a := newTestAPI(t, Options{DevMode: devMode})
+			a.storeDeck("streamer", newDeck("card|junk||-3;;;&01;&1;x"))
+
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+			assert.Equal(t, w.Code, 500)
+
+			body := map[string]string{}
+			assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			if devMode {
+				assert.Equal(t, body["error"], "card index out of bounds")
+			} else {
+				assert.Equal(t, body["error"], "failed to parse deck")
+			}
+			assert.Assert(t, body["request_id"] != "")
+			assert.Assert(t, strings.Contains(logs.String(), "err=\"card index out of bounds\""), logs.String())
+			assert.Assert(t, strings.Contains(logs.String(), "request_id="+body["request_id"]), logs.String())
+		})
+	}
+}
+
+func TestGetDeckHandlerExclude(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck("||0,0,1,2,3,3;;;Strike;a;Attack;;Defend;b;Skill;;Regret;c;Curse;;Parasite;d;Curse"))
+
+	testCases := []struct {
+		desc   string
+		query  string
+		output string
+	}{
+		{
+			desc:   "No filter",
+			query:  "",
+			output: "Defend x1\nParasite x2\nRegret x1\nStrike x2\n",
+		},
+		{
+			desc:   "By name",
+			query:  "?exclude=strike",
+			output: "Defend x1\nParasite x2\nRegret x1\n",
+		},
+		{
+			desc:   "By category",
+			query:  "?exclude=curse",
+			output: "Defend x1\nStrike x2\n",
+		},
+		{
+			desc:   "By name and category",
+			query:  "?exclude=curse,Defend",
+			output: "Strike x2\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer"+tc.query, nil))
+			assert.Equal(t, w.Code, 200)
+			assert.Equal(t, w.Body.String(), tc.output)
+		})
+	}
+}
+
+func TestGetDeckHandlerNameQuery(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+	a.storeDeck("streamer:ironclad", newDeck("||0;;;Strike;a;Red"))
+
+	testCases := []struct {
+		desc   string
+		target string
+		code   int
+		output string
+	}{
+		{
+			desc:   "Path",
+			target: "/deck/Streamer",
+			code:   200,
+			output: "card1 x3\ncard2 x2\ncard3 x1\n",
+		},
+		{
+			desc:   "Query",
+			target: "/deck?name=Streamer",
+			code:   200,
+			output: "card1 x3\ncard2 x2\ncard3 x1\n",
+		},
+		{
+			desc:   "Query with invalid path",
+			target: "/deck/%20streamer%20?name=streamer",
+			code:   200,
+			output: "card1 x3\ncard2 x2\ncard3 x1\n",
+		},
+		{
+			desc:   "Valid path wins",
+			target: "/deck/other?name=streamer",
+			code:   404,
+		},
+		{
+			desc:   "Query with slot",
+			target: "/deck?name=streamer&slot=Ironclad",
+			code:   200,
+			output: "Strike x1\n",
+		},
+		{
+			desc:   "Query with trailing slash",
+			target: "/deck/?name=streamer",
+			code:   200,
+			output: "card1 x3\ncard2 x2\ncard3 x1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			assert.Equal(t, w.Code, tc.code)
+			if tc.code == 200 {
+				assert.Equal(t, w.Body.String(), tc.output)
+			}
+		})
+	}
+}
+
+func TestGetDeckHandlerHeaderFooter(t *testing.T) {
+	a := newTestAPI(t, Options{Header: "=== My Deck ({total} cards) ===", Footer: "{unique} unique"})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	testCases := []struct {
+		desc   string
+		target string
+		output string
+	}{
+		{
+			desc:   "Deck",
+			target: "/deck/streamer",
+			output: "=== My Deck (6 cards) ===\ncard1 x3\ncard2 x2\ncard3 x1\n3 unique\n",
+		},
+		{
+			desc:   "Excluded cards",
+			target: "/deck/streamer?exclude=card1",
+			output: "=== My Deck (3 cards) ===\ncard2 x2\ncard3 x1\n2 unique\n",
+		},
+		{
+			desc:   "Grouped",
+			target: "/deck/streamer?group=type",
+			output: "=== My Deck (6 cards) ===\n[x] card1 x3\n[y] card2 x2\n[z] card3 x1\n3 unique\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			assert.Equal(t, w.Code, 200)
+			assert.Equal(t, w.Body.String(), tc.output)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer?format=json", nil))
+	assert.Assert(t, !strings.Contains(w.Body.String(), "My Deck"), w.Body.String())
+}
+
+func TestParseUpgrade(t *testing.T) {
+	testCases := []struct {
+		name    string
+		base    string
+		upgrade int
+	}{
+		{name: "Strike", base: "Strike"},
+		{name: "Strike+", base: "Strike", upgrade: 1},
+		{name: "Searing Blow+2", base: "Searing Blow", upgrade: 2},
+		{name: "Searing Blow+13", base: "Searing Blow", upgrade: 13},
+		{name: "+", base: "+"},
+		{name: "Card+x", base: "Card+x"},
+		{name: "Card+-1", base: "Card+-1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			base, upgrade := parseUpgrade(tc.name)
+			assert.Equal(t, base, tc.base)
+			assert.Equal(t, upgrade, tc.upgrade)
+		})
+	}
+}
+
+func TestDecompressDeckDetailedUpgrades(t *testing.T) {
+	details, err := testParser.decompressDeckDetailed("||0,1,2;;;Searing Blow+3;a;x;;Strike+;b;x;;Bash;c;x",
+		detailOptions{mergeIdentical: true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, details, []cardDetail{
+		{Name: "Searing Blow+3", Description: "a", Type: "x", Count: 1, BaseName: "Searing Blow", Upgrade: 3},
+		{Name: "Strike+", Description: "b", Type: "x", Count: 1, BaseName: "Strike", Upgrade: 1},
+		{Name: "Bash", Description: "c", Type: "x", Count: 1, BaseName: "Bash"},
+	})
+}
+
+func TestGetDeckHandlerMsgPack(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	for _, accept := range []string{"", "application/msgpack"} {
+		w := httptest.NewRecorder()
+		target := "/deck/streamer?format=msgpack"
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req = httptest.NewRequest(http.MethodGet, "/deck/streamer", nil)
+			req.Header.Set("Accept", accept)
+		}
+		a.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		assert.Equal(t, w.Header().Get("Content-Type"), "application/msgpack")
+
+		var result deckMsgPack
+		assert.NilError(t, codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(&result))
+		assert.DeepEqual(t, result, deckMsgPack{
+			Cards: []cardDetail{
+				{Name: "card1", Description: "junk", Type: "x", Count: 3, BaseName: "card1"},
+				{Name: "card2", Description: "junk", Type: "y", Count: 2, BaseName: "card2"},
+				{Name: "card3", Description: "junk", Type: "z", Count: 1, BaseName: "card3"},
+			},
+			Total:  6,
+			Unique: 3,
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/deck/streamer", nil)
+	req.Header.Set("Accept", "*/*")
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+	textETag := w.Header().Get("ETag")
+
+	// MsgPack responses have their own ETag, revalidated like the plain text ones.
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer?format=msgpack", nil))
+	etag := w.Header().Get("ETag")
+	assert.Assert(t, etag != "" && etag != textETag, etag)
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/deck/streamer?format=msgpack", nil)
+	req.Header.Set("If-None-Match", etag)
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 304)
+	assert.Equal(t, w.Body.Len(), 0)
+}
+
+func TestGetDeckHandlerMsgPackLang(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck("||0,0,1,2;;;Strike;a;Red;;Bash+;b;Red;;Madness;c;Colorless"))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/deck/streamer?format=msgpack&lang=de", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+	gz, err := gzip.NewReader(w.Body)
+	assert.NilError(t, err)
+	body, err := io.ReadAll(gz)
+	assert.NilError(t, err)
+
+	var result deckMsgPack
+	assert.NilError(t, codec.NewDecoderBytes(body, msgpackHandle).Decode(&result))
+	assert.DeepEqual(t, result, deckMsgPack{
+		Cards: []cardDetail{
+			{Name: "Schlag", Description: "a", Type: "Red", Count: 2, BaseName: "Schlag"},
+			{Name: "Bash+", Description: "b", Type: "Red", Count: 1, BaseName: "Hieb", Upgrade: 1},
+			{Name: "Madness", Description: "c", Type: "Colorless", Count: 1, BaseName: "Madness"},
+		},
+		Total:  4,
+		Unique: 3,
+	})
+
+	// The cached MsgPack encoding stays untranslated.
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer?format=msgpack", nil))
+	result = deckMsgPack{}
+	assert.NilError(t, codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(&result))
+	assert.Equal(t, result.Cards[0].Name, "Strike")
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer?format=msgpack&lang=xx", nil))
+	assert.Equal(t, w.Code, 400)
+}
+
+func TestGetDeckHandlerEmptyName(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	for _, target := range []string{"/deck", "/deck/", "/deck/%20", "/deck/?name=%20", "/deck?slot=ironclad"} {
+		t.Run(target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			assert.Equal(t, w.Code, 400)
+			assert.Equal(t, w.Body.String(), `{"error":"deck name required"}`)
+		})
+	}
+}
+
+func TestGetDeckHandlerGroupByType(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(
+		"||0,0,0,1,2,3,4;;;Strike;a;Red;;Bash;b;Red;;Madness;c;Colorless;;Regret;d;Curse;;Wish;e"))
+
+	testCases := []struct {
+		desc   string
+		query  string
+		code   int
+		output string
+	}{
+		{
+			desc:   "Grouped",
+			query:  "?group=type",
+			code:   200,
+			output: "[Colorless] Madness x1\n[Curse] Regret x1\n[Other] Wish x1\n[Red] Bash x1, Strike x3\n",
+		},
+		{
+			desc:   "Grouped with exclude",
+			query:  "?group=type&exclude=curse,bash",
+			code:   200,
+			output: "[Colorless] Madness x1\n[Other] Wish x1\n[Red] Strike x3\n",
+		},
+		{
+			desc:   "Unknown group",
+			query:  "?group=color",
+			code:   400,
+			output: `{"error":"unknown group"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer"+tc.query, nil))
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Body.String(), tc.output)
+		})
+	}
+}
+
+func TestGetAllDecksHandler(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	for _, upload := range []struct{ slot, deck string }{
+		{"ironclad", "||0,0,1;;;Strike;a;Red;;Bash;b;Red"},
+		{"Silent", "||0,1,1;;;Strike;a;Green;;Neutralize;b;Green"},
+	} {
+		req := newDeckUploadRequest(t, "text/plain", []byte(upload.deck))
+		req.URL.RawQuery = "slot=" + upload.slot
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200, w.Body.String())
+	}
+	a.storeDeck("other:ironclad", newDeck("||0;;;Defend;a;Red"))
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer/all", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "Bash x1\nNeutralize x2\nStrike x3\n")
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer?slot=silent", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "Neutralize x2\nStrike x1\n")
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/nobody/all", nil))
+	assert.Equal(t, w.Code, 404)
+}
+
+func TestGetDeckHandlerJSON(t *testing.T) {
+	const input = "||0,0,1;;;Strike;Deal 6 damage.;Red;;Bash;Deal 8 damage.;Red"
+	const details = `[{"name":"Strike","description":"Deal 6 damage.","type":"Red","count":2,` +
+		`"base_name":"Strike","upgrade":0},` +
+		`{"name":"Bash","description":"Deal 8 damage.","type":"Red","count":1,"base_name":"Bash","upgrade":0}]`
+
+	testCases := []struct {
+		desc        string
+		jsonp       bool
+		query       string
+		code        int
+		contentType string
+		body        string
+	}{
+		{
+			desc:        "JSON",
+			query:       "?format=json&shape=array",
+			code:        200,
+			contentType: "application/json; charset=utf-8",
+			body:        details,
+		},
+		{
+			desc:        "Callback ignored when disabled",
+			query:       "?format=json&shape=array&callback=render",
+			code:        200,
+			contentType: "application/json; charset=utf-8",
+			body:        details,
+		},
+		{
+			desc:        "JSONP",
+			jsonp:       true,
+			query:       "?format=json&shape=array&callback=$render_1",
+			code:        200,
+			contentType: "application/javascript; charset=utf-8",
+			body:        "$render_1(" + details + ");",
+		},
+		{
+			desc:        "Malformed callback",
+			jsonp:       true,
+			query:       "?format=json&shape=array&callback=alert(1)//",
+			code:        400,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"invalid callback"}`,
+		},
+		{
+			desc:        "Name and type",
+			query:       "?format=json&shape=array&fields=name,type",
+			code:        200,
+			contentType: "application/json; charset=utf-8",
+			body:        `[{"count":2,"name":"Strike","type":"Red"},{"count":1,"name":"Bash","type":"Red"}]`,
+		},
+		{
+			desc:        "Description",
+			query:       "?format=json&shape=array&fields=Description",
+			code:        200,
+			contentType: "application/json; charset=utf-8",
+			body:        `[{"count":2,"description":"Deal 6 damage."},{"count":1,"description":"Deal 8 damage."}]`,
+		},
+		{
+			desc:        "Fields with JSONP",
+			jsonp:       true,
+			query:       "?format=json&shape=array&fields=name&callback=render",
+			code:        200,
+			contentType: "application/javascript; charset=utf-8",
+			body:        `render([{"count":2,"name":"Strike"},{"count":1,"name":"Bash"}]);`,
+		},
+		{
+			desc:        "Unknown field",
+			query:       "?format=json&shape=array&fields=name,cost",
+			code:        400,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"unknown field \"cost\""}`,
+		},
+		{
+			desc:        "Object",
+			query:       "?format=json",
+			code:        200,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"cards":` + details + `,"total":3,"unique":2,"generation":1}`,
+		},
+		{
+			desc:        "Object with fields",
+			query:       "?format=json&shape=object&fields=name",
+			code:        200,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"cards":[{"count":2,"name":"Strike"},{"count":1,"name":"Bash"}],"total":3,"unique":2,"generation":1}`,
+		},
+		{
+			desc:        "Object with JSONP",
+			jsonp:       true,
+			query:       "?format=json&callback=render",
+			code:        200,
+			contentType: "application/javascript; charset=utf-8",
+			body:        `render({"cards":` + details + `,"total":3,"unique":2,"generation":1});`,
+		},
+		{
+			desc:        "Unknown shape",
+			query:       "?format=json&shape=list",
+			code:        400,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"unknown shape"}`,
+		},
+		{
+			desc:        "Unknown format",
+			query:       "?format=xml",
+			code:        400,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"error":"unknown format"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, Options{JSONP: tc.jsonp})
+			a.storeDeck("streamer", newDeck(input))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/deck/streamer", nil)
+			req.URL.RawQuery = strings.TrimPrefix(tc.query, "?")
+			a.Router.ServeHTTP(w, req)
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Header().Get("Content-Type"), tc.contentType)
+			assert.Equal(t, w.Body.String(), tc.body)
+		})
+	}
+}
+
+func TestDecompressDeckNameCasing(t *testing.T) {
+	const input = "||1,0,2,1;;;strike;a;Red;;Strike;b;Red;;STRIKE;c;Red"
+
+	testCases := []struct {
+		desc   string
+		casing NameCasing
+		output map[string]int
+	}{
+		{
+			desc:   "Exact",
+			casing: NameCasingExact,
+			output: map[string]int{"strike": 1, "Strike": 2, "STRIKE": 1},
+		},
+		{
+			desc:   "First seen",
+			casing: NameCasingFirstSeen,
+			output: map[string]int{"Strike": 4},
+		},
+		{
+			desc:   "Last seen",
+			casing: NameCasingLastSeen,
+			output: map[string]int{"Strike": 4},
+		},
+		{
+			desc:   "Smallest",
+			casing: NameCasingSmallest,
+			output: map[string]int{"STRIKE": 4},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := newParser(Options{NameCasing: tc.casing})
+			output, err := p.decompressDeck(input)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, output, tc.output)
+		})
+	}
+
+	// Last seen differs from first seen once the order changes.
+	p := newParser(Options{NameCasing: NameCasingLastSeen})
+	output, err := p.decompressDeck("||1,0,2;;;strike;a;Red;;Strike;b;Red;;STRIKE;c;Red")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"STRIKE": 3})
+
+	p = newParser(Options{NameCasing: NameCasingFirstSeen})
+	output, err = p.decompressDeck("||0,1,2;;;strike;a;Red;;Strike;b;Red;;STRIKE;c;Red")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, output, map[string]int{"strike": 3})
+}
+
+func TestGetDeckCountHandler(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(getBigDeckString()))
+
+	testCases := []struct {
+		desc  string
+		query string
+		code  int
+		body  string
+	}{
+		{desc: "JSON", query: "", code: 200, body: `{"total":100,"unique":52}`},
+		{desc: "Text", query: "?format=text", code: 200, body: "100"},
+		{desc: "Unknown format", query: "?format=xml", code: 400, body: `{"error":"unknown format"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer/count"+tc.query, nil))
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Body.String(), tc.body)
 		})
 	}
 }
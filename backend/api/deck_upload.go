@@ -0,0 +1,378 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+
+	errors2 "github.com/MaT1g3R/slaytherelics/errors"
+	"github.com/MaT1g3R/slaytherelics/models"
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+// maxDeckUploadSize bounds the compressed deck accepted by the upload handler.
+const maxDeckUploadSize = 1 << 20
+
+// postDeckHandler stores the compressed deck of the authenticated streamer, or that of one of its slots given a "slot"
+// query parameter. The streamer authenticates with basic auth using the same login and secret as the message endpoint.
+func (a *API) postDeckHandler(c *gin.Context) {
+	var err error
+	ctx, span := o11y.Tracer.Start(c.Request.Context(), "api: post deck")
+	defer o11y.End(&span, &err)
+
+	name := strings.ToLower(c.Param("name"))
+	span.SetAttributes(attribute.String("deck_name", name))
+	ctx = withDeckBaggage(ctx, name)
+
+	err = a.authenticateDeckUpload(c, ctx, name)
+	if err != nil {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxDeckUploadSize)
+	deck, err := readDeckUpload(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = a.validateAndStoreDeck(c, deckKey(name, c.Query("slot")), deck)
+}
+
+// maxBaggageDeckNameLength bounds the deck name propagated as baggage, longer names are truncated.
+const maxBaggageDeckNameLength = 64
+
+// withDeckBaggage adds the deck name to the baggage of ctx, so the spans of downstream calls can be correlated with
+// the deck. The name is sanitized to characters that never need escaping.
+func withDeckBaggage(ctx context.Context, name string) context.Context {
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if len(sanitized) > maxBaggageDeckNameLength {
+		sanitized = sanitized[:maxBaggageDeckNameLength]
+	}
+
+	member, err := baggage.NewMember("deck_name", sanitized)
+	if err != nil {
+		return ctx
+	}
+	b, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+// authenticateDeckUpload checks the deck name is accepted for upload and the basic auth credentials of the request
+// belong to the streamer owning the deck, responding with an error otherwise.
+func (a *API) authenticateDeckUpload(c *gin.Context, ctx context.Context, name string) error {
+	if !a.deckNameAllowed(name) {
+		err := &errors2.AuthError{Err: errors.New("deck name is not allowed")}
+		c.JSON(403, gin.H{"error": err.Error()})
+		return err
+	}
+
+	user, err := a.authenticateStreamer(c, ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(user.Login, name) {
+		err = &errors2.AuthError{Err: errors.New("deck name does not match streamer")}
+		c.JSON(403, gin.H{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// authenticateStreamer returns the streamer the basic auth credentials of the request belong to, the same login and
+// secret as the message endpoint, responding with an error otherwise.
+func (a *API) authenticateStreamer(c *gin.Context, ctx context.Context) (models.User, error) {
+	login, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		err := &errors2.AuthError{Err: errors.New("missing login or secret")}
+		c.JSON(401, gin.H{"error": err.Error()})
+		return models.User{}, err
+	}
+	user, err := a.users.AuthenticateRedis(ctx, login, secret)
+	authError := &errors2.AuthError{}
+	if errors.As(err, &authError) {
+		c.JSON(401, gin.H{"error": authError.Error()})
+		return models.User{}, err
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// requireAdmin only lets the requests of the admin logins through, authenticated like deck uploads.
+func (a *API) requireAdmin(c *gin.Context) {
+	user, err := a.authenticateStreamer(c, c.Request.Context())
+	if err != nil {
+		c.Abort()
+		return
+	}
+	if _, ok := a.adminLogins[strings.ToLower(user.Login)]; !ok {
+		c.AbortWithStatusJSON(403, gin.H{"error": "streamer is not an admin"})
+	}
+}
+
+// deckNameAllowed reports whether the lowercase deck name matches none of the denied names and, if any are set, one of
+// the allowed names.
+func (a *API) deckNameAllowed(name string) bool {
+	matchesAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			// The patterns are validated by New.
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if matchesAny(a.deniedNames) {
+		return false
+	}
+	return len(a.allowedNames) == 0 || matchesAny(a.allowedNames)
+}
+
+// validateAndStoreDeck stores deck if it decodes with the wire format of the request, responding with a 400 otherwise.
+func (a *API) validateAndStoreDeck(c *gin.Context, name, deck string) error {
+	if strings.TrimSpace(deck) == "" {
+		err := errors.New("deck upload is empty")
+		c.JSON(400, gin.H{"error": err.Error()})
+		return err
+	}
+
+	// Decks are served back as is by the raw endpoint, so anything a browser would sniff as markup or binary is refused
+	// before it's decoded, let alone stored.
+	if contentType := http.DetectContentType([]byte(deck)); !strings.HasPrefix(contentType, "text/plain") {
+		err := fmt.Errorf("deck upload is not plain text, detected %s", contentType)
+		c.JSON(400, gin.H{"error": err.Error()})
+		return err
+	}
+
+	format, err := parseDeckFormat(c.GetHeader(deckFormatHeader))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return err
+	}
+	pins, err := parseDeckPins(c.GetHeader(deckPinHeader))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return err
+	}
+
+	d := newPinnedDeck(deck, format, pins)
+	if !a.awaitParse(c, d) {
+		return c.Request.Context().Err()
+	}
+	err = d.parse(a.parser)
+	if errors.Is(err, ErrRenderTooLarge) {
+		c.JSON(413, deckError(err))
+		return err
+	}
+	if err != nil {
+		c.JSON(400, deckError(err))
+		return err
+	}
+
+	a.storeDeck(name, d)
+	c.Header(deckHashHeader, d.shortHash())
+	c.Data(200, "text/plain", []byte("Success\n"))
+	return nil
+}
+
+// postDeckValidateHandler decodes an uploaded deck without storing it, responding with its number of cards and of
+// distinct cards, or a 422 if it doesn't decode.
+func (a *API) postDeckValidateHandler(c *gin.Context) {
+	var err error
+	_, span := o11y.Tracer.Start(c.Request.Context(), "api: post deck validate")
+	defer o11y.End(&span, &err)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxDeckUploadSize)
+	deck, err := readDeckUpload(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(deck) == "" {
+		err = errors.New("deck upload is empty")
+		c.JSON(422, gin.H{"error": err.Error()})
+		return
+	}
+	format, err := parseDeckFormat(c.GetHeader(deckFormatHeader))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	d := newVersionedDeck(deck, format)
+	if !a.awaitParse(c, d) {
+		return
+	}
+	total, unique, err := d.Summary(a.parser)
+	if err != nil {
+		c.JSON(422, deckError(err))
+		return
+	}
+	c.JSON(200, gin.H{"total": total, "unique": unique})
+}
+
+// deckError is the response body for a deck that failed to decode, flagging truncated decks so they can be resent.
+func deckError(err error) gin.H {
+	if errors.Is(err, ErrTruncatedDeck) {
+		return gin.H{"error": err.Error(), "truncated": true}
+	}
+	return gin.H{"error": err.Error()}
+}
+
+// readDeckUpload extracts the compressed deck from the request, either as the raw body, a "deck" form field or a
+// "deck" multipart file part depending on the Content-Type.
+func readDeckUpload(c *gin.Context) (string, error) {
+	switch c.ContentType() {
+	case gin.MIMEPOSTForm:
+		deck, ok := c.GetPostForm("deck")
+		if !ok {
+			return "", errors.New("missing deck form field")
+		}
+		return deck, nil
+	case gin.MIMEMultipartPOSTForm:
+		if deck, ok := c.GetPostForm("deck"); ok {
+			return deck, nil
+		}
+		header, err := c.FormFile("deck")
+		if err != nil {
+			return "", err
+		}
+		f, err := header.Open()
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		return string(b), err
+	default:
+		b, err := io.ReadAll(c.Request.Body)
+		return string(b), err
+	}
+}
+
+// defaultUploadTTL is how long a chunked upload is kept without receiving a chunk.
+const defaultUploadTTL = 5 * time.Minute
+
+// chunkedUpload is a deck being uploaded in several chunks.
+type chunkedUpload struct {
+	buf     []byte
+	updated time.Time
+}
+
+// postDeckChunkHandler appends a chunk of the compressed deck to the pending upload of the streamer.
+func (a *API) postDeckChunkHandler(c *gin.Context) {
+	var err error
+	ctx, span := o11y.Tracer.Start(c.Request.Context(), "api: post deck chunk")
+	defer o11y.End(&span, &err)
+
+	name := strings.ToLower(c.Param("name"))
+	span.SetAttributes(attribute.String("deck_name", name))
+	ctx = withDeckBaggage(ctx, name)
+
+	err = a.authenticateDeckUpload(c, ctx, name)
+	if err != nil {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxDeckUploadSize)
+	chunk, err := readDeckUpload(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	size, err := a.appendUploadChunk(name, chunk)
+	if err != nil {
+		c.JSON(413, gin.H{"error": err.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int("upload_size", size))
+	c.Data(200, "text/plain", []byte("Success\n"))
+}
+
+// postDeckFinalizeHandler validates and stores the chunks uploaded so far as the deck of the streamer.
+func (a *API) postDeckFinalizeHandler(c *gin.Context) {
+	var err error
+	ctx, span := o11y.Tracer.Start(c.Request.Context(), "api: post deck finalize")
+	defer o11y.End(&span, &err)
+
+	name := strings.ToLower(c.Param("name"))
+	span.SetAttributes(attribute.String("deck_name", name))
+	ctx = withDeckBaggage(ctx, name)
+
+	err = a.authenticateDeckUpload(c, ctx, name)
+	if err != nil {
+		return
+	}
+
+	deck, ok := a.takeUpload(name)
+	if !ok {
+		c.JSON(404, gin.H{"error": "no pending upload"})
+		return
+	}
+	err = a.validateAndStoreDeck(c, deckKey(name, c.Query("slot")), deck)
+}
+
+func (a *API) appendUploadChunk(name, chunk string) (int, error) {
+	a.uploadLock.Lock()
+	defer a.uploadLock.Unlock()
+
+	now := a.clock.Now()
+	a.expireUploads(now)
+
+	upload, ok := a.uploads[name]
+	if !ok {
+		upload = &chunkedUpload{}
+		a.uploads[name] = upload
+	}
+	if len(upload.buf)+len(chunk) > maxDeckUploadSize {
+		delete(a.uploads, name)
+		return 0, errors.New("deck upload too large")
+	}
+	upload.buf = append(upload.buf, chunk...)
+	upload.updated = now
+	return len(upload.buf), nil
+}
+
+func (a *API) takeUpload(name string) (string, bool) {
+	a.uploadLock.Lock()
+	defer a.uploadLock.Unlock()
+
+	a.expireUploads(a.clock.Now())
+
+	upload, ok := a.uploads[name]
+	if !ok {
+		return "", false
+	}
+	delete(a.uploads, name)
+	return string(upload.buf), true
+}
+
+// expireUploads discards the uploads that haven't received a chunk within the upload TTL, uploadLock must be held.
+func (a *API) expireUploads(now time.Time) {
+	for name, upload := range a.uploads {
+		if now.Sub(upload.updated) > a.uploadTTL {
+			delete(a.uploads, name)
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+	"gotest.tools/v3/assert"
+
+	"github.com/MaT1g3R/slaytherelics/models"
+)
+
+const smallDeck = "card|junk||0,1,1,0,2,0;;;&01;&1;x;;&02;&1;y;;&03;&1;z"
+
+func newDeckUploadRequest(t *testing.T, contentType string, body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/deck/streamer", bytes.NewReader(body))
+	req.SetBasicAuth("streamer", "secret")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func TestPostDeckHandler(t *testing.T) {
+	multipartBody := func(field bool) (string, []byte) {
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		if field {
+			assert.NilError(t, w.WriteField("deck", smallDeck))
+		} else {
+			part, err := w.CreateFormFile("deck", "deck.txt")
+			assert.NilError(t, err)
+			_, err = part.Write([]byte(smallDeck))
+			assert.NilError(t, err)
+		}
+		assert.NilError(t, w.Close())
+		return w.FormDataContentType(), buf.Bytes()
+	}
+	multipartFileType, multipartFile := multipartBody(false)
+	multipartFieldType, multipartField := multipartBody(true)
+
+	testCases := []struct {
+		desc        string
+		contentType string
+		body        []byte
+	}{
+		{
+			desc:        "Raw body",
+			contentType: "text/plain",
+			body:        []byte(smallDeck),
+		},
+		{
+			desc:        "Raw body without content type",
+			contentType: "",
+			body:        []byte(smallDeck),
+		},
+		{
+			desc:        "Form field",
+			contentType: "application/x-www-form-urlencoded",
+			body:        []byte(url.Values{"deck": []string{smallDeck}}.Encode()),
+		},
+		{
+			desc:        "Multipart file",
+			contentType: multipartFileType,
+			body:        multipartFile,
+		},
+		{
+			desc:        "Multipart field",
+			contentType: multipartFieldType,
+			body:        multipartField,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, Options{})
+
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, newDeckUploadRequest(t, tc.contentType, tc.body))
+			assert.Equal(t, w.Code, 200, w.Body.String())
+			assert.Equal(t, storedEntry(a, "streamer").deck.raw, smallDeck)
+
+			w = httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+			assert.Equal(t, w.Code, 200)
+			assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+		})
+	}
+}
+
+func TestPostDeckHandlerRejected(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/deck/streamer", strings.NewReader(smallDeck))
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/deck/streamer", strings.NewReader(smallDeck))
+	req.SetBasicAuth("streamer", "wrong")
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/deck/someone-else", strings.NewReader(smallDeck))
+	req.SetBasicAuth("streamer", "secret")
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 403)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte("card|junk||3;;;&01")))
+	assert.Equal(t, w.Code, 400)
+
+	assert.Equal(t, storedDeckCount(a), 0)
+}
+
+func TestPostDeckHandlerNameLists(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opts Options
+		name string
+		code int
+	}{
+		{
+			desc: "Allowed",
+			opts: Options{AllowedNames: []string{"team_*", "Streamer"}},
+			name: "streamer",
+			code: 200,
+		},
+		{
+			desc: "Not allowed",
+			opts: Options{AllowedNames: []string{"team_*"}},
+			name: "streamer",
+			code: 403,
+		},
+		{
+			desc: "Denied glob",
+			opts: Options{DeniedNames: []string{"stream*"}},
+			name: "streamer",
+			code: 403,
+		},
+		{
+			desc: "Denied wins",
+			opts: Options{AllowedNames: []string{"streamer"}, DeniedNames: []string{"streamer"}},
+			name: "streamer",
+			code: 403,
+		},
+		{
+			desc: "Reserved name denied before authenticating",
+			opts: Options{DeniedNames: []string{"healthz", "metrics", "all"}},
+			name: "healthz",
+			code: 403,
+		},
+		{
+			desc: "Other names unaffected",
+			opts: Options{DeniedNames: []string{"healthz", "metrics", "all"}},
+			name: "streamer",
+			code: 200,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, tc.opts)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/deck/"+tc.name, strings.NewReader(smallDeck))
+			req.SetBasicAuth("streamer", "secret")
+			a.Router.ServeHTTP(w, req)
+			assert.Equal(t, w.Code, tc.code, w.Body.String())
+			if tc.code == 403 {
+				assert.Equal(t, w.Body.String(), `{"error":"deck name is not allowed"}`)
+			}
+		})
+	}
+}
+
+func TestPostDeckHandlerEmpty(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	for _, body := range []string{"", " \r\n\t"} {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte(body)))
+		assert.Equal(t, w.Code, 400)
+		assert.Equal(t, w.Body.String(), `{"error":"deck upload is empty"}`)
+	}
+	assert.Equal(t, storedDeckCount(a), 0)
+}
+
+func TestPostDeckHandlerNoCards(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Strict %t", strict), func(t *testing.T) {
+			a := newTestAPI(t, Options{Strict: strict})
+			get := func(name string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/"+name, nil))
+				return w
+			}
+
+			// Unlike an empty upload, a deck without cards at the start of a run is valid.
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte("||-;;;Strike;a;Red")))
+			assert.Equal(t, w.Code, 200)
+
+			w = get("streamer")
+			assert.Equal(t, w.Code, 200)
+			assert.Equal(t, w.Body.String(), "")
+			assert.Equal(t, w.Header().Get(deckGenerationHeader), "1")
+
+			w = get("never-published")
+			assert.Equal(t, w.Code, 404)
+			assert.Equal(t, w.Body.String(), `{"error":"deck not found"}`)
+		})
+	}
+}
+
+func TestPostDeckHandlerNotText(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	testCases := []struct {
+		desc string
+		body []byte
+		err  string
+	}{
+		{
+			desc: "Binary",
+			body: []byte("\x00\x01\x02card|junk||0;;;&01;&1;x"),
+			err:  `{"error":"deck upload is not plain text, detected application/octet-stream"}`,
+		},
+		{
+			desc: "HTML",
+			body: []byte("<html><script>alert(1)</script>||0;;;Strike;a;Red"),
+			err:  `{"error":"deck upload is not plain text, detected text/html; charset=utf-8"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", tc.body))
+			assert.Equal(t, w.Code, 400)
+			assert.Equal(t, w.Body.String(), tc.err)
+		})
+	}
+	assert.Equal(t, storedDeckCount(a), 0)
+}
+
+func TestPostDeckHandlerPins(t *testing.T) {
+	const deck = "||0,1,2,3;;;Strike;a;Red;;Bash;b;Red;;Defend;c;Red;;Ascender's Bane;d;Curse"
+	a := newTestAPI(t, Options{})
+
+	req := newDeckUploadRequest(t, "text/plain", []byte(deck))
+	req.Header.Set(deckPinHeader, "Strike, Bash,")
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	// The same deck without pins keeps the configured ones.
+	a.storeDeck("other", newDeck(deck))
+
+	testCases := []struct {
+		target string
+		output string
+	}{
+		{"/deck/streamer", "Ascender's Bane x1\nDefend x1\nStrike x1\nBash x1\n"},
+		{"/deck/streamer?exclude=Defend", "Ascender's Bane x1\nStrike x1\nBash x1\n"},
+		{"/deck/other", "Bash x1\nDefend x1\nStrike x1\nAscender's Bane x1\n"},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		assert.Equal(t, w.Code, 200)
+		assert.Equal(t, w.Body.String(), tc.output, tc.target)
+	}
+
+	req = newDeckUploadRequest(t, "text/plain", []byte(deck))
+	req.Header.Set(deckPinHeader, strings.Repeat("Strike,", maxDeckPins+1))
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, w.Body.String(), `{"error":"deck has more than 16 pinned cards"}`)
+}
+
+func postDeckChunk(a *API, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.SetBasicAuth("streamer", "secret")
+	a.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPostDeckChunks(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	w := postDeckChunk(a, "/deck/streamer/chunk", smallDeck[:20])
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	w = postDeckChunk(a, "/deck/streamer/chunk", smallDeck[20:])
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.Equal(t, storedDeckCount(a), 0)
+
+	w = postDeckChunk(a, "/deck/streamer/finalize", "")
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.Equal(t, storedEntry(a, "streamer").deck.raw, smallDeck)
+	assert.Equal(t, len(a.uploads), 0)
+
+	// The upload is consumed by finalizing it.
+	w = postDeckChunk(a, "/deck/streamer/finalize", "")
+	assert.Equal(t, w.Code, 404)
+
+	// An invalid assembled deck is rejected.
+	w = postDeckChunk(a, "/deck/streamer/chunk", "card|junk||3;;;")
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	w = postDeckChunk(a, "/deck/streamer/finalize", "")
+	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, storedEntry(a, "streamer").deck.raw, smallDeck)
+}
+
+func TestPostDeckChunksExpired(t *testing.T) {
+	clock := newFakeClock()
+	a := newTestAPI(t, Options{UploadTTL: time.Minute, clock: clock})
+
+	w := postDeckChunk(a, "/deck/streamer/chunk", smallDeck[:20])
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	clock.Advance(time.Minute + time.Nanosecond)
+	w = postDeckChunk(a, "/deck/streamer/chunk", smallDeck[20:])
+	assert.Equal(t, w.Code, 200, w.Body.String())
+
+	// Only the second chunk survived, which isn't a valid deck on its own.
+	assert.Equal(t, string(a.uploads["streamer"].buf), smallDeck[20:])
+	w = postDeckChunk(a, "/deck/streamer/finalize", "")
+	assert.Equal(t, w.Code, 400)
+
+	w = postDeckChunk(a, "/deck/streamer/chunk", smallDeck)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	clock.Advance(time.Minute + time.Nanosecond)
+	w = postDeckChunk(a, "/deck/streamer/finalize", "")
+	assert.Equal(t, w.Code, 404)
+	assert.Equal(t, len(a.uploads), 0)
+	assert.Equal(t, storedDeckCount(a), 0)
+}
+
+func TestPostDeckHandlerFormat(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		format string
+		code   int
+	}{
+		{desc: "Unversioned", format: "", code: 200},
+		{desc: "Known version", format: "1", code: 200},
+		{desc: "Unknown version", format: "2", code: 400},
+		{desc: "Invalid version", format: "v1", code: 400},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, Options{})
+			req := newDeckUploadRequest(t, "text/plain", []byte(smallDeck))
+			if tc.format != "" {
+				req.Header.Set("X-Deck-Format", tc.format)
+			}
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, req)
+			assert.Equal(t, w.Code, tc.code, w.Body.String())
+			if tc.code != 200 {
+				assert.Assert(t, strings.Contains(w.Body.String(), "unsupported deck format"), w.Body.String())
+				return
+			}
+
+			w = httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+			assert.Equal(t, w.Code, 200)
+			assert.Equal(t, w.Header().Get("X-Deck-Format"), "1")
+		})
+	}
+}
+
+// baggageUsers records the deck name baggage of the contexts it authenticates with.
+type baggageUsers struct {
+	usersStub
+	deckNames []string
+}
+
+func (u *baggageUsers) AuthenticateRedis(ctx context.Context, userID, token string) (models.User, error) {
+	u.deckNames = append(u.deckNames, baggage.FromContext(ctx).Member("deck_name").Value())
+	return u.usersStub.AuthenticateRedis(ctx, userID, token)
+}
+
+func TestPostDeckHandlerBaggage(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	users := &baggageUsers{}
+	a.users = users
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 200, w.Body.String())
+
+	req := httptest.NewRequest(http.MethodPost, "/deck/"+url.PathEscape("Some Name;"+strings.Repeat("x", 100)), nil)
+	req.SetBasicAuth("streamer", "secret")
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 403)
+
+	assert.DeepEqual(t, users.deckNames, []string{"streamer", "some_name_" + strings.Repeat("x", 54)})
+}
+
+func TestPostDeckValidateHandler(t *testing.T) {
+	testCases := []struct {
+		desc string
+		deck string
+		code int
+		body string
+	}{
+		{
+			desc: "Valid",
+			deck: smallDeck,
+			code: 200,
+			body: `{"total":6,"unique":3}`,
+		},
+		{
+			desc: "Invalid",
+			deck: "card|junk||0,1,-9;;;&01;&1;x;;&02;&1;y",
+			code: 422,
+			body: `{"error":"card index out of bounds"}`,
+		},
+		{
+			desc: "Truncated",
+			deck: "card|junk||0,1,9;;;&01;&1;x;;&02;&1;y",
+			code: 422,
+			body: `{"error":"deck is truncated: card index 9 beyond the 2 cards","truncated":true}`,
+		},
+		{
+			desc: "Empty",
+			deck: " ",
+			code: 422,
+			body: `{"error":"deck upload is empty"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a := newTestAPI(t, Options{})
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/deck/validate", strings.NewReader(tc.deck)))
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Body.String(), tc.body)
+			assert.Equal(t, storedDeckCount(a), 0)
+			assert.Equal(t, len(a.decks), 0)
+		})
+	}
+}
+
+func TestGetRawDeckHandler(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 200)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "card1 x3\ncard2 x2\ncard3 x1\n")
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer/raw", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, w.Body.String(), smallDeck)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/nobody/raw", nil))
+	assert.Equal(t, w.Code, 404)
+}
+
+func TestGetDeckDictHandler(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 200)
+	a.storeDeck("nodict", newDeck("||0;;;Strike;a;Red"))
+
+	testCases := []struct {
+		desc   string
+		target string
+		code   int
+		body   string
+	}{
+		{
+			desc:   "Dictionary",
+			target: "/deck/streamer/dict",
+			code:   200,
+			body:   `["card","junk"]`,
+		},
+		{
+			desc:   "Empty dictionary",
+			target: "/deck/nodict/dict",
+			code:   200,
+			body:   `[]`,
+		},
+		{
+			desc:   "Missing deck",
+			target: "/deck/nobody/dict",
+			code:   404,
+			body:   `{"error":"deck not found"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Body.String(), tc.body)
+		})
+	}
+}
+
+func TestGetDeckDictHandlerCRLF(t *testing.T) {
+	a := newTestAPI(t, Options{StripCR: true})
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "text/plain", []byte("Strike\r|Red\r||0,0;;;&0;a;&1\r\n")))
+	assert.Equal(t, w.Code, 200)
+
+	// The entries are those the deck is decoded with, without the carriage returns.
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer/dict", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), `["Strike","Red"]`)
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Body.String(), "Strike x2\n")
+}
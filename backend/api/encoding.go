@@ -0,0 +1,97 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// The content encodings decks are served with, indexing preferredEncodings.
+const (
+	encodingBrotli = iota
+	encodingGzip
+	// encodingIdentity is the index of an unencoded response.
+	encodingIdentity = -1
+)
+
+// preferredEncodings are the Content-Encoding names of the supported encodings, most preferred first: brotli beats
+// gzip on small text such as decks.
+var preferredEncodings = [...]string{"br", "gzip"}
+
+// negotiateEncoding returns the most preferred encoding accepted by an Accept-Encoding header value, or
+// encodingIdentity if none is.
+func negotiateEncoding(header string) int {
+	accepted := make(map[string]bool)
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		ok := true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			value, err := strconv.ParseFloat(q, 64)
+			ok = err == nil && value > 0
+		}
+		if name == "*" {
+			wildcard = ok
+			continue
+		}
+		if _, seen := accepted[name]; !seen && name != "" {
+			accepted[name] = ok
+		}
+	}
+
+	for i, name := range preferredEncodings {
+		if ok, listed := accepted[name]; ok || (!listed && wildcard) {
+			return i
+		}
+	}
+	return encodingIdentity
+}
+
+// encodeBody returns body compressed with encoding. The best compression level is several times slower than the
+// default one, so it's only used if best, for bodies compressed once and cached.
+func encodeBody(encoding int, body []byte, best bool) []byte {
+	buf := bytes.Buffer{}
+	switch encoding {
+	case encodingBrotli:
+		level := brotli.DefaultCompression
+		if best {
+			level = brotli.BestCompression
+		}
+		w := brotli.NewWriterLevel(&buf, level)
+		_, _ = w.Write(body)
+		_ = w.Close()
+	case encodingGzip:
+		level := gzip.DefaultCompression
+		if best {
+			level = gzip.BestCompression
+		}
+		w, _ := gzip.NewWriterLevel(&buf, level)
+		_, _ = w.Write(body)
+		_ = w.Close()
+	default:
+		return body
+	}
+	return buf.Bytes()
+}
+
+// encodingCache holds the encoded forms of a body, each encoded at most once on first use.
+type encodingCache struct {
+	once   [len(preferredEncodings)]sync.Once
+	bodies [len(preferredEncodings)][]byte
+}
+
+// encoded returns body compressed with encoding, encoding it only the first time.
+func (e *encodingCache) encoded(encoding int, body []byte) []byte {
+	if encoding == encodingIdentity {
+		return body
+	}
+	e.once[encoding].Do(func() {
+		e.bodies[encoding] = encodeBody(encoding, body, true)
+	})
+	return e.bodies[encoding]
+}
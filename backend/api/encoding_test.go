@@ -0,0 +1,129 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/exp/slices"
+	"gotest.tools/v3/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		header   string
+		encoding int
+	}{
+		{"", encodingIdentity},
+		{"identity", encodingIdentity},
+		{"gzip", encodingGzip},
+		{"br", encodingBrotli},
+		{"gzip, deflate, br", encodingBrotli},
+		{"BR;q=0.5, gzip;q=1.0", encodingBrotli},
+		{"br;q=0, gzip", encodingGzip},
+		{"br;q=0, gzip;q=0", encodingIdentity},
+		{"*", encodingBrotli},
+		{"br;q=0, *", encodingGzip},
+		{"*;q=0", encodingIdentity},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.header, func(t *testing.T) {
+			assert.Equal(t, negotiateEncoding(tc.header), tc.encoding)
+		})
+	}
+}
+
+func TestGetDeckHandlerEncoding(t *testing.T) {
+	const rendered = "card1 x3\ncard2 x2\ncard3 x1\n"
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	get := func(acceptEncoding, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		a.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		assert.Assert(t, slices.Contains(w.Header().Values("Vary"), "Accept-Encoding"))
+		return w
+	}
+
+	testCases := []struct {
+		desc           string
+		acceptEncoding string
+		target         string
+		encoding       string
+		decode         func(io.Reader) io.Reader
+	}{
+		{
+			desc:     "Identity",
+			target:   "/deck/streamer",
+			encoding: "",
+			decode:   func(r io.Reader) io.Reader { return r },
+		},
+		{
+			desc:           "Brotli",
+			acceptEncoding: "gzip, br",
+			target:         "/deck/streamer",
+			encoding:       "br",
+			decode:         func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		},
+		{
+			desc:           "Gzip",
+			acceptEncoding: "gzip",
+			target:         "/deck/streamer",
+			encoding:       "gzip",
+			decode: func(r io.Reader) io.Reader {
+				gz, err := gzip.NewReader(r)
+				assert.NilError(t, err)
+				return gz
+			},
+		},
+		{
+			desc:           "Brotli without cache",
+			acceptEncoding: "br",
+			target:         "/deck/streamer/all",
+			encoding:       "br",
+			decode:         func(r io.Reader) io.Reader { return brotli.NewReader(r) },
+		},
+		{
+			desc:           "Gzip without cache",
+			acceptEncoding: "gzip",
+			target:         "/deck/streamer/all",
+			encoding:       "gzip",
+			decode: func(r io.Reader) io.Reader {
+				gz, err := gzip.NewReader(r)
+				assert.NilError(t, err)
+				return gz
+			},
+		},
+	}
+
+	etags := make(map[string]bool)
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			// The second response comes from the cache of the deck.
+			for i := 0; i < 2; i++ {
+				w := get(tc.acceptEncoding, tc.target)
+				assert.Equal(t, w.Header().Get("Content-Encoding"), tc.encoding)
+				body, err := io.ReadAll(tc.decode(w.Body))
+				assert.NilError(t, err)
+				assert.Equal(t, string(body), rendered)
+				etags[w.Header().Get("ETag")] = true
+			}
+		})
+	}
+	// Every encoding has its own ETag.
+	assert.Equal(t, len(etags), 3)
+
+	req := httptest.NewRequest(http.MethodGet, "/deck/streamer", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	req.Header.Set("If-None-Match", get("br", "/deck/streamer").Header().Get("ETag"))
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 304)
+}
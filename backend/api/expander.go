@@ -0,0 +1,281 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+// expander expands the wildcards of a compressed body in a single pass, producing the same output as replacing every
+// "&<WILDCARDS[i]>" with compressionDict[i] in turn from the last dictionary entry to the first.
+//
+// Replacing entry i can introduce new wildcards, either inside the entry itself or across its boundaries with the
+// surrounding text, which are then expanded by the later replacements of the entries before i. To match that
+// without re-scanning the text for every entry, each byte is emitted along with the replacement step at which it
+// became adjacent to the previously emitted byte: a wildcard pair "&x" is only expanded if x's dictionary index is
+// below that step.
+//
+// The expander works on bytes rather than runes, which is also correct for UTF-8 bodies: '&' and every wildcard are
+// ASCII, while every byte of a multibyte UTF-8 sequence is 0x80 or above, so a wildcard pair never starts or ends
+// inside a multibyte character.
+type expander struct {
+	dict [][]byte
+	// lookup maps a wildcard byte to its dictionary index, or -1 if the byte is not a wildcard of the dictionary.
+	lookup [256]int
+
+	out []byte
+	// amps holds the adjacency step of each '&' trailing out, the only bytes that can still be removed from out.
+	amps []int
+	// bound caps the adjacency step of the next emitted byte after a replacement.
+	bound int
+	// used records which dictionary entries were expanded at least once.
+	used []bool
+	// emitted counts every byte emitted, to bound the work spent on dictionaries of empty or self referencing entries.
+	emitted int
+	// flushed counts the bytes dropped from the front of out by a decompressReader, which still count towards the
+	// decompressed size.
+	flushed int
+	// substitutions counts the wildcards expanded.
+	substitutions int
+}
+
+// maxExpansionWork bounds the number of bytes emitted while expanding a body.
+const maxExpansionWork = 4 * maxDecompressedSize
+
+func newExpander(dict [][]byte) *expander {
+	e := &expander{dict: dict, bound: math.MaxInt, used: make([]bool, len(dict))}
+	for i := range e.lookup {
+		e.lookup[i] = -1
+	}
+	for i := range dict {
+		e.lookup[WILDCARDS[i]] = i
+	}
+	return e
+}
+
+// expand returns body with every wildcard of the dictionary expanded.
+func (e *expander) expand(body []byte) ([]byte, error) {
+	e.reset(len(body))
+	for _, b := range body {
+		if err := e.emit(b, len(e.dict)); err != nil {
+			return nil, err
+		}
+	}
+	return e.out, nil
+}
+
+// reset clears the state of the last expansion, making room for size bytes of output.
+func (e *expander) reset(size int) {
+	e.out = make([]byte, 0, size)
+	e.amps = e.amps[:0]
+	e.bound = math.MaxInt
+	e.emitted = 0
+	e.flushed = 0
+	e.substitutions = 0
+	for i := range e.used {
+		e.used[i] = false
+	}
+}
+
+// parallelExpansionThreshold is the body size above which expandParallel splits the body across goroutines, smaller
+// bodies expanding faster than the goroutines start.
+const parallelExpansionThreshold = 64 << 10
+
+// expandParallel is expand, splitting bodies above parallelExpansionThreshold into at most chunks chunks expanded
+// concurrently. A chunk only starts at a byte that is neither '&' nor a wildcard of the dictionary: such a byte never
+// forms a wildcard with what precedes it nor passes on a replacement step, so expanding the chunks separately gives
+// the same output as expanding the whole body.
+func (e *expander) expandParallel(body []byte, chunks int) ([]byte, error) {
+	if len(body) <= parallelExpansionThreshold || chunks <= 1 {
+		return e.expand(body)
+	}
+
+	starts := []int{0}
+	for k := 1; k < chunks; k++ {
+		i := k * len(body) / chunks
+		if last := starts[len(starts)-1]; i <= last {
+			i = last + 1
+		}
+		for i < len(body) && (body[i] == '&' || e.lookup[body[i]] >= 0) {
+			i++
+		}
+		if i >= len(body) {
+			break
+		}
+		starts = append(starts, i)
+	}
+	if len(starts) == 1 {
+		return e.expand(body)
+	}
+
+	expanders := make([]*expander, len(starts))
+	outs := make([][]byte, len(starts))
+	errs := make([]error, len(starts))
+	wg := sync.WaitGroup{}
+	for k, start := range starts {
+		end := len(body)
+		if k+1 < len(starts) {
+			end = starts[k+1]
+		}
+		expanders[k] = newExpander(e.dict)
+		wg.Add(1)
+		go func(k int, chunk []byte) {
+			defer wg.Done()
+			outs[k], errs[k] = expanders[k].expand(chunk)
+		}(k, body[start:end])
+	}
+	wg.Wait()
+
+	size := 0
+	for k := range outs {
+		if errs[k] != nil {
+			return nil, errs[k]
+		}
+		size += len(outs[k])
+	}
+	if size > maxDecompressedSize {
+		return nil, errors.New("decompressed deck too large")
+	}
+
+	e.out = make([]byte, 0, size)
+	e.substitutions = 0
+	for i := range e.used {
+		e.used[i] = false
+	}
+	for k, out := range outs {
+		e.out = append(e.out, out...)
+		e.substitutions += expanders[k].substitutions
+		for i, used := range expanders[k].used {
+			e.used[i] = e.used[i] || used
+		}
+	}
+	return e.out, nil
+}
+
+// emit appends b, which became adjacent to the previously emitted byte at replacement step step.
+func (e *expander) emit(b byte, step int) error {
+	e.emitted++
+	if e.emitted > maxExpansionWork {
+		return errors.New("decompressed deck too large")
+	}
+	if e.bound < step {
+		step = e.bound
+	}
+	e.bound = math.MaxInt
+
+	if len(e.amps) > 0 {
+		if i := e.lookup[b]; i >= 0 && i < step {
+			ampStep := e.amps[len(e.amps)-1]
+			e.amps = e.amps[:len(e.amps)-1]
+			e.out = e.out[:len(e.out)-1]
+			return e.replace(i, ampStep)
+		}
+	}
+
+	if e.flushed+len(e.out) >= maxDecompressedSize {
+		return errors.New("decompressed deck too large")
+	}
+	e.out = append(e.out, b)
+	if b == '&' {
+		e.amps = append(e.amps, step)
+	} else {
+		e.amps = e.amps[:0]
+	}
+	return nil
+}
+
+// replace emits dictionary entry i in place of its wildcard, whose '&' became adjacent to the byte before it at
+// replacement step ampStep.
+func (e *expander) replace(i, ampStep int) error {
+	e.used[i] = true
+	e.substitutions++
+	// The first byte of the entry is adjacent to the byte before the wildcard once both the wildcard and everything
+	// between the two has been replaced.
+	e.bound = i
+	if ampStep < i {
+		e.bound = ampStep
+	}
+	for _, b := range e.dict[i] {
+		if err := e.emit(b, i); err != nil {
+			return err
+		}
+	}
+	// Likewise for the byte following the wildcard and the last byte of the entry.
+	if i < e.bound {
+		e.bound = i
+	}
+	return nil
+}
+
+// unused returns the index of the first dictionary entry the last expansion never expanded, or -1 if all were.
+func (e *expander) unused() int {
+	for i, used := range e.used {
+		if !used {
+			return i
+		}
+	}
+	return -1
+}
+
+// decompressReaderBufferSize is the number of compressed bytes a decompressReader expands at a time.
+const decompressReaderBufferSize = 4 << 10
+
+// decompressReader expands the wildcards of a compressed body as it's read.
+type decompressReader struct {
+	e    *expander
+	body io.Reader
+	buf  []byte
+	// pending is the expanded output not read yet, the front of e.out.
+	pending []byte
+	err     error
+}
+
+// NewDecompressReader returns a reader of body with every wildcard of dict expanded, reading the same bytes as
+// expanding the whole body at once without holding it in memory. Only the output of the last few compressed bytes
+// is buffered: the bytes emitted before the trailing '&' of the output can't be removed by a later wildcard, so
+// they're final.
+func NewDecompressReader(dict [][]byte, body io.Reader) io.Reader {
+	if len(dict) > len(WILDCARDS) {
+		return &decompressReader{err: errors.New("compression dictionary too large")}
+	}
+	e := newExpander(dict)
+	e.reset(decompressReaderBufferSize)
+	return &decompressReader{e: e, body: body, buf: make([]byte, decompressReaderBufferSize)}
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// fill expands the next compressed bytes of the body into pending, once everything pending was read.
+func (r *decompressReader) fill() {
+	// Only the trailing '&' are left of the output read so far.
+	final := len(r.e.out) - len(r.e.amps)
+	r.e.flushed += final
+	r.e.out = append(r.e.out[:0], r.e.out[final:]...)
+
+	n, err := r.body.Read(r.buf)
+	for _, b := range r.buf[:n] {
+		if err := r.e.emit(b, len(r.e.dict)); err != nil {
+			r.err = err
+			return
+		}
+	}
+	final = len(r.e.out) - len(r.e.amps)
+	if err != nil {
+		// Nothing follows the trailing '&' anymore.
+		final = len(r.e.out)
+		r.e.amps = r.e.amps[:0]
+		r.err = err
+	}
+	r.pending = r.e.out[:final]
+}
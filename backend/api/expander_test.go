@@ -0,0 +1,297 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"gotest.tools/v3/assert"
+)
+
+// replaceExpand is the reference expansion the expander must match: replace every wildcard in turn, from the last
+// dictionary entry to the first.
+func replaceExpand(dict []string, body string) string {
+	for i := len(dict) - 1; i >= 0; i-- {
+		body = strings.ReplaceAll(body, fmt.Sprintf("&%c", WILDCARDS[i]), dict[i])
+	}
+	return body
+}
+
+func toByteDict(dict []string) [][]byte {
+	result := make([][]byte, 0, len(dict))
+	for _, word := range dict {
+		result = append(result, []byte(word))
+	}
+	return result
+}
+
+func TestExpanderMatchesReplace(t *testing.T) {
+	const alphabet = "&&&0123ab"
+	r := rand.New(rand.NewSource(1))
+	randomString := func(maxLen int) string {
+		b := make([]byte, r.Intn(maxLen+1))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 100000; i++ {
+		dict := make([]string, r.Intn(5))
+		for j := range dict {
+			dict[j] = randomString(4)
+		}
+		body := randomString(12)
+
+		output, err := newExpander(toByteDict(dict)).expand([]byte(body))
+		assert.NilError(t, err)
+		assert.Equal(t, string(output), replaceExpand(dict, body), "dict %q body %q", dict, body)
+	}
+}
+
+func TestExpanderTooLarge(t *testing.T) {
+	// Every entry doubles the previous one.
+	dict := []string{"boom"}
+	for i := 1; i < 40; i++ {
+		dict = append(dict, fmt.Sprintf("&%c&%c", WILDCARDS[i-1], WILDCARDS[i-1]))
+	}
+	body := fmt.Sprintf("&%c", WILDCARDS[len(dict)-1])
+	_, err := newExpander(toByteDict(dict)).expand([]byte(body))
+	assert.Error(t, err, "decompressed deck too large")
+
+	// Same but expanding to nothing, which must still be bounded.
+	dict[0] = ""
+	_, err = newExpander(toByteDict(dict)).expand([]byte(body))
+	assert.Error(t, err, "decompressed deck too large")
+}
+
+// BenchmarkWildcardLookup compares the expander's array lookup of wildcard bytes against a map.
+func BenchmarkWildcardLookup(b *testing.B) {
+	body := []byte(getBigDeckString())
+	e := newExpander(make([][]byte, len(WILDCARDS)))
+	m := make(map[byte]int, len(WILDCARDS))
+	for i := range WILDCARDS {
+		m[WILDCARDS[i]] = i
+	}
+
+	b.Run("Array", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			found := 0
+			for _, c := range body {
+				if e.lookup[c] >= 0 {
+					found++
+				}
+			}
+		}
+	})
+	b.Run("Map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			found := 0
+			for _, c := range body {
+				if _, ok := m[c]; ok {
+					found++
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkExpanderSetup compares the setup of the expander for a full dictionary against compiling a regexp for
+// every wildcard, as decompression used to.
+func BenchmarkExpanderSetup(b *testing.B) {
+	dict := make([][]byte, len(WILDCARDS))
+	for i := range dict {
+		dict[i] = []byte(fmt.Sprintf("card%d", i))
+	}
+
+	b.Run("Expander", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = newExpander(dict)
+		}
+	})
+	b.Run("Regexp", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range WILDCARDS {
+				_ = regexp.MustCompile(regexp.QuoteMeta(fmt.Sprintf("&%c", WILDCARDS[j])))
+			}
+		}
+	})
+}
+
+func TestExpanderEveryWildcard(t *testing.T) {
+	dict := make([]string, len(WILDCARDS))
+	var body, output strings.Builder
+	for i := range dict {
+		dict[i] = fmt.Sprintf("card%d", i)
+		fmt.Fprintf(&body, "&%c,", WILDCARDS[i])
+		fmt.Fprintf(&output, "card%d,", i)
+	}
+
+	expanded, err := newExpander(toByteDict(dict)).expand([]byte(body.String()))
+	assert.NilError(t, err)
+	assert.Equal(t, string(expanded), output.String())
+}
+
+func TestExpanderUTF8(t *testing.T) {
+	dict := []string{"Pokémon", "🐉 Dragon", "Ærø &0"}
+	testCases := []struct {
+		desc   string
+		body   string
+		output string
+	}{
+		{"Wildcards", "&0 &1 &2", "Pokémon 🐉 Dragon Ærø Pokémon"},
+		{"Ampersand before multibyte", "&é &🐉 &Æ", "&é &🐉 &Æ"},
+		{"Multibyte before wildcard", "é&0🐉&1", "éPokémon🐉🐉 Dragon"},
+		{"Multibyte only", "café ☕ naïve", "café ☕ naïve"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			output, err := newExpander(toByteDict(dict)).expand([]byte(tc.body))
+			assert.NilError(t, err)
+			assert.Equal(t, string(output), tc.output)
+			assert.Equal(t, string(output), replaceExpand(dict, tc.body))
+		})
+	}
+}
+
+func TestExpandParallelMatchesExpand(t *testing.T) {
+	const alphabet = "&&&0123ab;"
+	r := rand.New(rand.NewSource(1))
+	randomString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 50; i++ {
+		dict := make([]string, r.Intn(5))
+		for j := range dict {
+			dict[j] = randomString(r.Intn(5))
+		}
+		body := []byte(randomString(parallelExpansionThreshold + r.Intn(parallelExpansionThreshold)))
+
+		serial, err := newExpander(toByteDict(dict)).expand(body)
+		assert.NilError(t, err)
+		for _, chunks := range []int{2, 3, 8} {
+			e := newExpander(toByteDict(dict))
+			parallel, err := e.expandParallel(body, chunks)
+			assert.NilError(t, err)
+			assert.Assert(t, string(parallel) == string(serial), "dict %q chunks %d", dict, chunks)
+
+			serialExpander := newExpander(toByteDict(dict))
+			_, _ = serialExpander.expand(body)
+			assert.DeepEqual(t, e.used, serialExpander.used)
+			assert.Equal(t, e.substitutions, serialExpander.substitutions)
+		}
+	}
+}
+
+func TestExpandParallelTooLarge(t *testing.T) {
+	// Every chunk is within the limit, but not all of them together.
+	dict := []string{strings.Repeat("a", 40)}
+	body := []byte(strings.Repeat("&0 ", maxDecompressedSize/40))
+	assert.Assert(t, len(body) > parallelExpansionThreshold)
+	_, err := newExpander(toByteDict(dict)).expandParallel(body, 4)
+	assert.Error(t, err, "decompressed deck too large")
+}
+
+// BenchmarkExpandParallel compares the serial and parallel expansion of a large body.
+func BenchmarkExpandParallel(b *testing.B) {
+	deck := getBigDeckString()
+	dictPart, body, _ := strings.Cut(deck, "||")
+	dict := toByteDict(strings.Split(dictPart, "|"))
+	large := []byte(strings.Repeat(body+";;", 8*parallelExpansionThreshold/len(body)))
+
+	b.Run("Serial", func(b *testing.B) {
+		b.SetBytes(int64(len(large)))
+		for i := 0; i < b.N; i++ {
+			_, _ = newExpander(dict).expand(large)
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		b.SetBytes(int64(len(large)))
+		for i := 0; i < b.N; i++ {
+			_, _ = newExpander(dict).expandParallel(large, runtime.GOMAXPROCS(0))
+		}
+	})
+}
+
+// readSmallChunks reads r to the end a few bytes at a time.
+func readSmallChunks(t *testing.T, r io.Reader, size int) ([]byte, error) {
+	t.Helper()
+	var out []byte
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out = append(out, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+func TestDecompressReaderMatchesExpand(t *testing.T) {
+	const alphabet = "&&&0123ab"
+	r := rand.New(rand.NewSource(1))
+	randomString := func(maxLen int) string {
+		b := make([]byte, r.Intn(maxLen+1))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 10000; i++ {
+		dict := make([]string, r.Intn(5))
+		for j := range dict {
+			dict[j] = randomString(4)
+		}
+		body := randomString(12)
+
+		want, err := newExpander(toByteDict(dict)).expand([]byte(body))
+		assert.NilError(t, err)
+		// One compressed byte at a time, so wildcards are split across reads of the body.
+		got, err := readSmallChunks(t,
+			NewDecompressReader(toByteDict(dict), iotest.OneByteReader(strings.NewReader(body))), 1+r.Intn(3))
+		assert.NilError(t, err)
+		assert.Equal(t, string(got), string(want), "dict %q body %q", dict, body)
+	}
+}
+
+func TestDecompressReaderDeck(t *testing.T) {
+	newTestMeter(t)
+	deck := getBigDeckString()
+	want, err := testParser.decompress(deck)
+	assert.NilError(t, err)
+
+	dict, body, ok := strings.Cut(deck, DefaultFormat.DictSeparator)
+	assert.Assert(t, ok)
+	r := NewDecompressReader(toByteDict(strings.Split(dict, DefaultFormat.WordSeparator)), strings.NewReader(body))
+	got, err := readSmallChunks(t, r, 7)
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), want)
+}
+
+func TestDecompressReaderTooLarge(t *testing.T) {
+	dict := [][]byte{[]byte(strings.Repeat("a", 40))}
+	body := strings.Repeat("&0", maxDecompressedSize/40+1)
+	_, err := io.Copy(io.Discard, NewDecompressReader(dict, strings.NewReader(body)))
+	assert.Error(t, err, "decompressed deck too large")
+
+	_, err = io.ReadAll(NewDecompressReader(make([][]byte, len(WILDCARDS)+1), strings.NewReader(body)))
+	assert.Error(t, err, "compression dictionary too large")
+}
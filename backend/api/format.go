@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// deckFormatHeader is the header carrying the wire format version of an uploaded deck, echoed back when serving it.
+const deckFormatHeader = "X-Deck-Format"
+
+// deckGenerationHeader is the header carrying the generation of a served deck, which increases every time a deck is
+// stored under the name so overlays know when to re-render.
+const deckGenerationHeader = "X-Deck-Generation"
+
+// deckHashHeader is the header carrying the short hash of a deck, which serves it at /d/<hash> for shareable links.
+const deckHashHeader = "X-Deck-Hash"
+
+// deckFormatV1 is the compressed deck encoding described by Format, assumed when an upload has no version.
+const deckFormatV1 = 1
+
+// parseDeckFormat returns the wire format version of the deck header value, rejecting unsupported versions.
+func parseDeckFormat(header string) (int, error) {
+	if header == "" {
+		return deckFormatV1, nil
+	}
+	format, err := strconv.Atoi(header)
+	if err != nil || format != deckFormatV1 {
+		return 0, fmt.Errorf("unsupported deck format %q", header)
+	}
+	return format, nil
+}
+
+// Format describes the separators of the compressed deck encoding sent by the mod.
+type Format struct {
+	// DictSeparator separates the compression dictionary from the compressed body.
+	DictSeparator string
+	// WordSeparator separates the entries of the compression dictionary.
+	WordSeparator string
+	// SectionSeparator separates the deck indices from the card list.
+	SectionSeparator string
+	// CardSeparator separates the cards of the card list.
+	CardSeparator string
+	// FieldSeparator separates the fields of a single card.
+	FieldSeparator string
+}
+
+// DefaultFormat is the encoding used by the Slay the Relics Exporter mod.
+var DefaultFormat = Format{
+	DictSeparator:    "||",
+	WordSeparator:    "|",
+	SectionSeparator: ";;;",
+	CardSeparator:    ";;",
+	FieldSeparator:   ";",
+}
+
+// withDefaults fills in any unset separator from DefaultFormat.
+func (f Format) withDefaults() Format {
+	if f.DictSeparator == "" {
+		f.DictSeparator = DefaultFormat.DictSeparator
+	}
+	if f.WordSeparator == "" {
+		f.WordSeparator = DefaultFormat.WordSeparator
+	}
+	if f.SectionSeparator == "" {
+		f.SectionSeparator = DefaultFormat.SectionSeparator
+	}
+	if f.CardSeparator == "" {
+		f.CardSeparator = DefaultFormat.CardSeparator
+	}
+	if f.FieldSeparator == "" {
+		f.FieldSeparator = DefaultFormat.FieldSeparator
+	}
+	return f
+}
+
+// validate checks the separators are unambiguous, once defaults are filled in.
+func (f Format) validate() error {
+	separators := []struct {
+		name, value string
+	}{
+		{"dict", f.DictSeparator},
+		{"word", f.WordSeparator},
+		{"section", f.SectionSeparator},
+		{"card", f.CardSeparator},
+		{"field", f.FieldSeparator},
+	}
+	for i, a := range separators {
+		for _, b := range separators[i+1:] {
+			if a.value == b.value {
+				return fmt.Errorf("%s and %s separators are both %q", a.name, b.name, a.value)
+			}
+		}
+	}
+	return nil
+}
+
+// deckBaseGenerationHeader is the request header carrying the generation of the deck an overlay already has, so
+// only the changes since are served when that generation is still known.
+const deckBaseGenerationHeader = "If-Deck-Generation"
+
+// deckPinHeader is the header of an upload listing the cards to show after the others, comma separated, in place of
+// the configured pinned cards.
+const deckPinHeader = "X-Deck-Pin"
+
+// maxDeckPins bounds the number of cards pinned by an upload.
+const maxDeckPins = 16
+
+// parseDeckPins returns the pinned cards of the pin header value, leaving out empty names.
+func parseDeckPins(header string) ([]string, error) {
+	var pins []string
+	for _, pin := range strings.Split(header, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	if len(pins) > maxDeckPins {
+		return nil, fmt.Errorf("deck has more than %d pinned cards", maxDeckPins)
+	}
+	return pins, nil
+}
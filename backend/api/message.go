@@ -3,7 +3,6 @@ package api
 import (
 	"context"
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -52,11 +51,7 @@ func (a *API) postMessageHandler(c *gin.Context) {
 	}
 
 	if req.MessageType == 4 {
-		func() {
-			a.deckLock.Lock()
-			defer a.deckLock.Unlock()
-			a.deckLists[strings.ToLower(user.Login)] = message["k"].(string)
-		}()
+		a.storeDeck(user.Login, newDeck(message["k"].(string)))
 	}
 	err = a.broadcast(c, ctx, req, user.ID, message)
 }
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// drainRetryAfter is how long clients are told to wait before retrying a request rejected while draining, about as
+// long as the replacing server takes to come up.
+const drainRetryAfter = 5 * time.Second
+
+// Shutdown gracefully stops srv serving the Router. New requests are rejected with a 503 for the drain grace period,
+// while the health check keeps being served, so load balancers take the server out of rotation before its listeners
+// close. The requests in flight then complete, or until ctx is done.
+func (a *API) Shutdown(ctx context.Context, srv *http.Server) error {
+	a.draining.Store(true)
+	if a.drainGracePeriod > 0 {
+		timer := time.NewTimer(a.drainGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	return srv.Shutdown(ctx)
+}
+
+// rejectWhileDraining responds with a 503 to the requests received once Shutdown is called, telling clients when to
+// retry rather than resetting their connection.
+func (a *API) rejectWhileDraining(c *gin.Context) {
+	if !a.draining.Load() {
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+	c.Header("Connection", "close")
+	c.AbortWithStatusJSON(503, gin.H{"error": "server is shutting down"})
+}
+
+// getHealthHandler reports the server is up, even while draining.
+func (a *API) getHealthHandler(c *gin.Context) {
+	c.Data(200, "text/plain", []byte("OK\n"))
+}
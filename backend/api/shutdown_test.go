@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRejectWhileDraining(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+	assert.Equal(t, get("/deck/streamer").Code, 200)
+
+	a.draining.Store(true)
+	w := get("/deck/streamer")
+	assert.Equal(t, w.Code, 503)
+	assert.Equal(t, w.Header().Get("Retry-After"), "5")
+	assert.Equal(t, w.Body.String(), `{"error":"server is shutting down"}`)
+	assert.Equal(t, get("/healthz").Code, 200)
+
+	a.draining.Store(false)
+	assert.Equal(t, get("/deck/streamer").Code, 200)
+}
+
+func TestShutdown(t *testing.T) {
+	a := newTestAPI(t, Options{DrainGracePeriod: 500 * time.Millisecond})
+	a.storeDeck("streamer", newDeck(smallDeck))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	srv := &http.Server{Handler: a.Router}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(target string) (*http.Response, error) {
+		resp, err := client.Get("http://" + ln.Addr().String() + target)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return resp, err
+	}
+	resp, err := get("/deck/streamer")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, 200)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- a.Shutdown(context.Background(), srv) }()
+
+	// New requests still reach the server during the grace period, to be rejected.
+	for resp.StatusCode != 503 {
+		resp, err = get("/deck/streamer")
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, resp.Header.Get("Retry-After"), "5")
+	resp, err = get("/healthz")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, 200)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned during the grace period: %v", err)
+	default:
+	}
+
+	assert.NilError(t, <-shutdown)
+	assert.Equal(t, <-served, http.ErrServerClosed)
+	_, err = get("/healthz")
+	assert.Assert(t, err != nil)
+}
+
+func TestShutdownContextDone(t *testing.T) {
+	a := newTestAPI(t, Options{DrainGracePeriod: time.Hour})
+	srv := &http.Server{Handler: a.Router}
+
+	// The grace period is cut short once ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NilError(t, a.Shutdown(ctx, srv))
+	assert.Equal(t, srv.ListenAndServe(), http.ErrServerClosed)
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serverStats counts what the API did since it started.
+type serverStats struct {
+	// coldParses is the number of decks parsed.
+	coldParses atomic.Int64
+	// hits and misses are the number of deck reads finding a stored deck and not finding one.
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// getStatsHandler serves the stored decks and the server stats, for status pages.
+func (a *API) getStatsHandler(c *gin.Context) {
+	decks, bytes := func() (int, int64) {
+		a.deckLock.RLock()
+		defer a.deckLock.RUnlock()
+		var bytes int64
+		for _, d := range a.decks {
+			bytes += d.size.Load()
+		}
+		return len(a.deckLists), bytes
+	}()
+
+	hits, misses := a.stats.hits.Load(), a.stats.misses.Load()
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+
+	c.JSON(200, gin.H{
+		"decks":       decks,
+		"bytes":       bytes,
+		"cold_parses": a.stats.coldParses.Load(),
+		"hit_ratio":   hitRatio,
+	})
+}
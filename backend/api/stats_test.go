@@ -0,0 +1,46 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGetStatsHandler(t *testing.T) {
+	a := newTestAPI(t, Options{Admin: true, AdminLogins: []string{"streamer"}})
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newDeckUploadRequest(t, "", []byte(smallDeck)))
+	assert.Equal(t, w.Code, 200)
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer", nil))
+	assert.Equal(t, w.Code, 200)
+	rendered := w.Body.Len()
+
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newAdminRequest(http.MethodGet, "/stats"))
+	assert.Equal(t, w.Code, 200)
+	var stats struct {
+		Decks      int     `json:"decks"`
+		Bytes      int     `json:"bytes"`
+		ColdParses int     `json:"cold_parses"`
+		HitRatio   float64 `json:"hit_ratio"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, stats.Decks, 1)
+	assert.Equal(t, stats.Bytes, len(smallDeck)+rendered)
+	assert.Equal(t, stats.ColdParses, 1)
+	assert.Equal(t, stats.HitRatio, 1.0)
+}
+
+func TestGetStatsHandlerNotAdmin(t *testing.T) {
+	a := newTestAPI(t, Options{})
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, newAdminRequest(http.MethodGet, "/stats"))
+	assert.Equal(t, w.Code, 404)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// translationFiles holds a JSON object mapping English card names to their localized name per language, named after
+// the language code such as "de.json".
+//
+//go:embed translations/*.json
+var translationFiles embed.FS
+
+// loadTranslations returns the card name translations of every embedded language, by language code.
+func loadTranslations() (map[string]map[string]string, error) {
+	entries, err := translationFiles.ReadDir("translations")
+	if err != nil {
+		return nil, err
+	}
+	translations := make(map[string]map[string]string, len(entries))
+	for _, entry := range entries {
+		b, err := translationFiles.ReadFile(path.Join("translations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		table := make(map[string]string)
+		if err := json.Unmarshal(b, &table); err != nil {
+			return nil, fmt.Errorf("invalid translations %s: %w", entry.Name(), err)
+		}
+		translations[strings.TrimSuffix(entry.Name(), ".json")] = table
+	}
+	return translations, nil
+}
+
+// translateCounts returns the card counts d with every card name found in table translated, the others kept as is.
+// Cards translated to the same name are counted together.
+func translateCounts(d map[string]int, table map[string]string) map[string]int {
+	result := make(map[string]int, len(d))
+	for card, count := range d {
+		result[translateCard(card, table)] += count
+	}
+	return result
+}
+
+// translateDetails translates the card names of details with table, in place.
+func translateDetails(details []cardDetail, table map[string]string) {
+	for i := range details {
+		details[i].Name = translateCard(details[i].Name, table)
+		details[i].BaseName = translateCard(details[i].BaseName, table)
+	}
+}
+
+func translateCard(card string, table map[string]string) string {
+	if translated, ok := table[card]; ok {
+		return translated
+	}
+	return card
+}
+
+// translated returns p sorting the translations of its pinned cards last, for decks translated with table.
+func (p parser) translated(table map[string]string) parser {
+	pins := make(map[string]int, len(p.pins))
+	for card, i := range p.pins {
+		pins[translateCard(card, table)] = i
+	}
+	p.pins = pins
+	return p
+}
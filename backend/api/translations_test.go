@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// englishDeck has two translated cards and one without a German translation.
+const englishDeck = "Strike|junk||0,0,1,2;;;&0;&1;x;;Bash;&1;y;;Zap;&1;z"
+
+func TestGetDeckHandlerLang(t *testing.T) {
+	a := newTestAPI(t, Options{})
+	a.storeDeck("streamer", newDeck(englishDeck))
+
+	testCases := []struct {
+		desc   string
+		target string
+		code   int
+		output string
+	}{
+		{
+			desc:   "English",
+			target: "/deck/streamer",
+			code:   200,
+			output: "Bash x1\nStrike x2\nZap x1\n",
+		},
+		{
+			desc:   "Translated",
+			target: "/deck/streamer?lang=de",
+			code:   200,
+			output: "Hieb x1\nSchlag x2\nZap x1\n",
+		},
+		{
+			desc:   "Excluded English name",
+			target: "/deck/streamer?lang=DE&exclude=Strike",
+			code:   200,
+			output: "Hieb x1\nZap x1\n",
+		},
+		{
+			desc:   "Grouped",
+			target: "/deck/streamer?lang=de&group=type",
+			code:   200,
+			output: "[x] Schlag x2\n[y] Hieb x1\n[z] Zap x1\n",
+		},
+		{
+			desc:   "Unknown language",
+			target: "/deck/streamer?lang=xx",
+			code:   400,
+			output: `{"error":"unknown language"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			assert.Equal(t, w.Code, tc.code)
+			assert.Equal(t, w.Body.String(), tc.output)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deck/streamer?format=json&shape=array&lang=de", nil))
+	assert.Equal(t, w.Code, 200)
+	var details []cardDetail
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	names := make([]string, 0, len(details))
+	for _, d := range details {
+		names = append(names, d.Name)
+	}
+	assert.DeepEqual(t, names, []string{"Schlag", "Hieb", "Zap"})
+}
+
+func TestTranslateCounts(t *testing.T) {
+	table := map[string]string{"Strike": "Schlag", "Strike+": "Schlag"}
+	got := translateCounts(map[string]int{"Strike": 2, "Strike+": 1, "Zap": 1}, table)
+	assert.DeepEqual(t, got, map[string]int{"Schlag": 3, "Zap": 1})
+}
+
+func TestLoadTranslations(t *testing.T) {
+	translations, err := loadTranslations()
+	assert.NilError(t, err)
+	assert.Equal(t, translations["de"]["Strike"], "Schlag")
+}
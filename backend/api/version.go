@@ -0,0 +1,15 @@
+package api
+
+import (
+	"runtime"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version is the server version, set at build time with
+// -ldflags "-X github.com/MaT1g3R/slaytherelics/api.Version=<version>".
+var Version = "dev"
+
+func (a *API) getVersionHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"version": Version, "go": runtime.Version()})
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestGetVersionHandler(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "1.2.3"
+
+	a := newTestAPI(t, Options{})
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, w.Code, 200)
+
+	body := map[string]string{}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.DeepEqual(t, body, map[string]string{"version": "1.2.3", "go": runtime.Version()})
+}
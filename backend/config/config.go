@@ -1,6 +1,10 @@
 package config
 
-import "github.com/alecthomas/kong"
+import (
+	"time"
+
+	"github.com/alecthomas/kong"
+)
 
 type Config struct {
 	ListenAddr      string `env:"LISTEN_ADDR" default:":8080"`
@@ -11,6 +15,22 @@ type Config struct {
 	ExtensionSecret string `env:"EXTENSION_SECRET"`
 	OtelEndpoint    string `env:"OTEL_EXPORTER_ENDPOINT"`
 	RedisAddr       string `env:"REDIS_ADDR" default:"localhost:6379"`
+
+	SlowRequestThreshold time.Duration `env:"SLOW_REQUEST_THRESHOLD" default:"250ms"`
+	MissingDeckStatus    int           `env:"MISSING_DECK_STATUS" default:"404"`
+	GinDebug             bool          `env:"GIN_DEBUG"`
+	MetricNames          []string      `env:"METRIC_NAMES"`
+	BasePath             string        `env:"BASE_PATH"`
+	Admin                bool          `env:"ADMIN"`
+	AdminLogins          []string      `env:"ADMIN_LOGINS"`
+	ExpectedMaxDeckSize  int           `env:"EXPECTED_MAX_DECK_SIZE" default:"1000"`
+	MaxStreamsPerIP      int           `env:"MAX_STREAMS_PER_IP"`
+	DeckHeader           string        `env:"DECK_HEADER"`
+	DeckFooter           string        `env:"DECK_FOOTER"`
+	AllowedDeckNames     []string      `env:"ALLOWED_DECK_NAMES"`
+	DeniedDeckNames      []string      `env:"DENIED_DECK_NAMES"`
+	DefaultDeck          string        `env:"DEFAULT_DECK"`
+	DrainGracePeriod     time.Duration `env:"DRAIN_GRACE_PERIOD" default:"5s"`
 }
 
 func Load() Config {
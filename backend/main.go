@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 
@@ -26,14 +31,32 @@ func main() {
 		panic(err)
 	}
 
-	err = a.Router.Run(cfg.ListenAddr)
-	if err != nil {
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: a.Router}
+	stop, stopCancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopCancel()
+	// ListenAndServe returns as soon as Shutdown is called, the requests in flight are waited for through done.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-stop.Done()
+		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, cfg.DrainGracePeriod+shutdownTimeout)
+		defer shutdownCancel()
+		_ = a.Shutdown(shutdownCtx, srv)
+	}()
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
+	<-done
 }
 
+// shutdownTimeout bounds how long in flight requests are waited for on shutdown, after the drain grace period.
+const shutdownTimeout = 10 * time.Second
+
 func initialize(ctx context.Context, cfg config.Config) (_ *api.API, cancel func(context.Context), err error) {
 	cancel = o11y.Init("slay-the-relics")
+	o11y.SlowRequestThreshold = cfg.SlowRequestThreshold
 
 	ctx, span := o11y.Tracer.Start(ctx, "init")
 	defer o11y.End(&span, &err)
@@ -64,8 +87,30 @@ func initialize(ctx context.Context, cfg config.Config) (_ *api.API, cancel func
 		return nil, cancel, err
 	}
 
+	// Requests are already logged by o11y, gin's debug output is only wanted when debugging.
+	if cfg.GinDebug {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
 	span.AddEvent("starting server")
-	a, err := api.New(twitchClient, users, broadcaster)
+	a, err := api.New(twitchClient, users, broadcaster, api.Options{
+		MissingDeckStatus:   cfg.MissingDeckStatus,
+		GinDebug:            cfg.GinDebug,
+		MetricNames:         cfg.MetricNames,
+		BasePath:            cfg.BasePath,
+		Admin:               cfg.Admin,
+		AdminLogins:         cfg.AdminLogins,
+		ExpectedMaxDeckSize: cfg.ExpectedMaxDeckSize,
+		MaxStreamsPerIP:     cfg.MaxStreamsPerIP,
+		Header:              cfg.DeckHeader,
+		Footer:              cfg.DeckFooter,
+		AllowedNames:        cfg.AllowedDeckNames,
+		DeniedNames:         cfg.DeniedDeckNames,
+		DefaultDeck:         cfg.DefaultDeck,
+		DrainGracePeriod:    cfg.DrainGracePeriod,
+	})
 	return a, cancel, err
 }
 
@@ -0,0 +1,58 @@
+package o11y
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/exp/slices"
+)
+
+// MetricLabelKeys are the keys of the labels AddMetricLabel adds to the request metrics, other keys are ignored so
+// handlers can't blow up the cardinality of the metrics.
+var MetricLabelKeys = []string{"character"}
+
+// maxMetricLabelLength bounds the length of a metric label value, longer values are truncated.
+const maxMetricLabelLength = 32
+
+type metricLabelsKey struct{}
+
+// metricLabels are the labels added to the metrics of a request while it's handled.
+type metricLabels struct {
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+// withMetricLabels returns ctx holding the labels AddMetricLabel adds to.
+func withMetricLabels(ctx context.Context) (context.Context, *metricLabels) {
+	labels := &metricLabels{labels: make(map[string]string)}
+	return context.WithValue(ctx, metricLabelsKey{}, labels), labels
+}
+
+// AddMetricLabel labels the metrics of the request of ctx with key=value once it's handled, replacing any previous
+// value of key. It does nothing outside of Middleware or for keys missing from MetricLabelKeys.
+func AddMetricLabel(ctx context.Context, key, value string) {
+	labels, ok := ctx.Value(metricLabelsKey{}).(*metricLabels)
+	if !ok || !slices.Contains(MetricLabelKeys, key) {
+		return
+	}
+	if len(value) > maxMetricLabelLength {
+		// Cutting a multibyte character leaves invalid bytes, which are dropped.
+		value = strings.ToValidUTF8(value[:maxMetricLabelLength], "")
+	}
+	labels.mu.Lock()
+	defer labels.mu.Unlock()
+	labels.labels[key] = value
+}
+
+// attributes returns the labels as metric attributes.
+func (l *metricLabels) attributes() []attribute.KeyValue {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attrs := make([]attribute.KeyValue, 0, len(l.labels))
+	for key, value := range l.labels {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+	return attrs
+}
@@ -1,17 +1,38 @@
 package o11y
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
+// SlowRequestThreshold is the latency above which a request is logged as slow.
+var SlowRequestThreshold = 250 * time.Millisecond
+
+// nonPublicKey marks a request's route as excluded from the public request SLO.
+const nonPublicKey = "o11y.non_public"
+
+// NonPublic marks the route it's used on as an admin or debug route, its requests are tagged with public=false so
+// they can be left out of the public request SLO.
+func NonPublic(c *gin.Context) {
+	c.Set(nonPublicKey, true)
+}
+
+// unmatchedRoute is the target label of the requests matching no route.
+const unmatchedRoute = "unmatched"
+
 func Middleware(c *gin.Context) {
 	var err error
+	start := time.Now()
 
 	ctx, span := Tracer.Start(c.Request.Context(), "http.request", trace.WithSpanKind(trace.SpanKindServer))
 	defer End(&span, &err)
+	ctx, labels := withMetricLabels(ctx)
 
 	req := c.Request.WithContext(ctx)
 	c.Request = req
@@ -34,27 +55,56 @@ func Middleware(c *gin.Context) {
 
 	err = c.Err()
 	status := c.Writer.Status()
+	duration := time.Since(start)
+	public := !c.GetBool(nonPublicKey)
+
+	if duration > SlowRequestThreshold {
+		Logger.WarnCtx(ctx, "slow request",
+			slog.String("route", c.FullPath()),
+			slog.String("method", method),
+			slog.Int("status_code", status),
+			slog.Duration("duration", duration),
+		)
+	}
 
+	// Metrics are labelled with the route template rather than the path, so every deck name shares a series.
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
 	requestCounter, _ := Meter.Int64Counter("http.requests")
 	requestHistogram, _ := Meter.Int64Histogram("http.requests.content_length")
+	durationHistogram, _ := Meter.Int64Histogram("http.requests.duration_ms")
+	requestAttrs := metric.WithAttributes(append([]attribute.KeyValue{
+		attribute.String("target", route),
+		attribute.String("method", method),
+		attribute.Int("status_code", status),
+		attribute.Bool("public", public),
+	}, labels.attributes()...)...)
 	if requestCounter != nil {
-		requestCounter.Add(ctx, 1,
-			metric.WithAttributes(
-				attribute.String("target", target),
-				attribute.String("method", method),
-				attribute.Int("status_code", status),
-			),
-		)
+		requestCounter.Add(ctx, 1, requestAttrs)
 	}
 	if requestHistogram != nil {
-		requestHistogram.Record(ctx, contentLength,
+		requestHistogram.Record(ctx, contentLength, requestAttrs)
+	}
+	if durationHistogram != nil {
+		durationHistogram.Record(ctx, duration.Milliseconds(), requestAttrs)
+	}
+
+	responseCounter, _ := Meter.Int64Counter("http.responses")
+	if responseCounter != nil {
+		responseCounter.Add(ctx, 1,
 			metric.WithAttributes(
-				attribute.String("target", target),
-				attribute.String("method", method),
-				attribute.Int("status_code", status),
+				attribute.String("class", statusClass(status)),
+				attribute.Bool("public", public),
 			),
 		)
 	}
 
 	span.SetAttributes(attribute.Int("http.status_code", status))
 }
+
+// statusClass returns the class of an HTTP status code, such as "4xx" for 404.
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,193 @@
+package o11y
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/exp/slog"
+	"gotest.tools/v3/assert"
+)
+
+func TestMiddlewareSlowRequest(t *testing.T) {
+	ctx := context.Background()
+	cancel := Init("test")
+	defer cancel(ctx)
+
+	logs := &bytes.Buffer{}
+	defer func(l *slog.Logger, threshold time.Duration) {
+		Logger = l
+		SlowRequestThreshold = threshold
+	}(Logger, SlowRequestThreshold)
+	Logger = slog.New(slog.NewTextHandler(logs))
+	SlowRequestThreshold = 10 * time.Millisecond
+
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/fast/:name", func(c *gin.Context) {
+		c.Status(200)
+	})
+	r.GET("/slow/:name", func(c *gin.Context) {
+		time.Sleep(2 * SlowRequestThreshold)
+		c.Status(200)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast/foo", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, logs.Len(), 0)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow/foo", nil))
+	assert.Equal(t, w.Code, 200)
+	assert.Assert(t, bytes.Contains(logs.Bytes(), []byte("slow request")), logs.String())
+	assert.Assert(t, bytes.Contains(logs.Bytes(), []byte("route=/slow/:name")), logs.String())
+	assert.Assert(t, bytes.Contains(logs.Bytes(), []byte("duration=")), logs.String())
+}
+
+func TestMiddlewareNonPublic(t *testing.T) {
+	ctx := context.Background()
+	cancel := Init("test")
+	defer cancel(ctx)
+
+	reader := sdkmetric.NewManualReader()
+	defer func(m metric.Meter) { Meter = m }(Meter)
+	Meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/deck/:name", func(c *gin.Context) {
+		c.Status(200)
+	})
+	r.GET("/version", NonPublic, func(c *gin.Context) {
+		c.Status(200)
+	})
+
+	for _, target := range []string{"/deck/foo", "/version"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, w.Code, 200)
+	}
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(ctx, &rm))
+	public := make(map[string]bool)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "http.requests" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				target, _ := dp.Attributes.Value("target")
+				value, ok := dp.Attributes.Value("public")
+				assert.Assert(t, ok)
+				public[target.AsString()] = value.AsBool()
+			}
+		}
+	}
+	assert.DeepEqual(t, public, map[string]bool{"/deck/:name": true, "/version": false})
+}
+
+func TestMiddlewareStatusClass(t *testing.T) {
+	ctx := context.Background()
+	cancel := Init("test")
+	defer cancel(ctx)
+
+	reader := sdkmetric.NewManualReader()
+	defer func(m metric.Meter) { Meter = m }(Meter)
+	Meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/deck/:name", func(c *gin.Context) {
+		c.Status(200)
+	})
+	r.GET("/fail", func(c *gin.Context) {
+		c.Status(500)
+	})
+
+	for _, target := range []string{"/deck/foo", "/deck/bar", "/missing", "/fail"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(ctx, &rm))
+	classes := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "http.responses" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				class, ok := dp.Attributes.Value("class")
+				assert.Assert(t, ok)
+				classes[class.AsString()] += dp.Value
+			}
+		}
+	}
+	assert.DeepEqual(t, classes, map[string]int64{"2xx": 2, "4xx": 1, "5xx": 1})
+}
+
+func TestMiddlewareMetricLabels(t *testing.T) {
+	ctx := context.Background()
+	cancel := Init("test")
+	defer cancel(ctx)
+
+	reader := sdkmetric.NewManualReader()
+	defer func(m metric.Meter) { Meter = m }(Meter)
+	Meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/deck/:name", func(c *gin.Context) {
+		AddMetricLabel(c.Request.Context(), "character", "ironclad")
+		// Keys outside of MetricLabelKeys are left out.
+		AddMetricLabel(c.Request.Context(), "seed", "12345")
+		c.Status(200)
+	})
+	r.GET("/version", func(c *gin.Context) {
+		c.Status(200)
+	})
+
+	for _, target := range []string{"/deck/foo", "/version"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, w.Code, 200)
+	}
+	// Outside of a request, labels are ignored.
+	AddMetricLabel(ctx, "character", "silent")
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(ctx, &rm))
+	characters := make(map[string]string)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "http.requests" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				target, _ := dp.Attributes.Value("target")
+				character, _ := dp.Attributes.Value("character")
+				characters[target.AsString()] = character.AsString()
+				_, ok := dp.Attributes.Value("seed")
+				assert.Assert(t, !ok)
+			}
+		}
+	}
+	assert.DeepEqual(t, characters, map[string]string{"/deck/:name": "ironclad", "/version": ""})
+}
+
+func TestAddMetricLabelTruncates(t *testing.T) {
+	ctx, labels := withMetricLabels(context.Background())
+	AddMetricLabel(ctx, "character", strings.Repeat("a", maxMetricLabelLength+1))
+	assert.DeepEqual(t, labels.labels, map[string]string{"character": strings.Repeat("a", maxMetricLabelLength)})
+}
@@ -10,10 +10,12 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
 var Tracer trace.Tracer
 var Meter metric.Meter
+var Logger = slog.Default()
 
 func End(span *trace.Span, err *error) {
 	defer (*span).End()
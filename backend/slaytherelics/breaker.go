@@ -0,0 +1,209 @@
+package slaytherelics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+// ErrNotFound is returned by a Store for a key it has no value for.
+var ErrNotFound = errors.New("key not found")
+
+// ErrBreakerOpen is returned in place of calling the store while the circuit breaker is open.
+var ErrBreakerOpen = errors.New("store circuit breaker is open")
+
+// Store is a key value store backing the users.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// redisStore is a Store backed by Redis.
+type redisStore struct {
+	rdb *redis.Client
+}
+
+func (s redisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := s.rdb.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (s redisStore) Set(ctx context.Context, key string, value []byte) error {
+	return s.rdb.Set(ctx, key, value, 0).Err()
+}
+
+const (
+	// breakerThreshold is the number of consecutive store failures opening the circuit breaker.
+	breakerThreshold = 5
+	// breakerCooldown is how long the circuit breaker fast-fails before letting a call through again.
+	breakerCooldown = 30 * time.Second
+	// breakerFallbackSize bounds the number of values kept to serve gets from while the store can't be reached, the
+	// least recently stored being forgotten first.
+	breakerFallbackSize = 1024
+)
+
+// breakerStore is a Store failing fast once the store it wraps fails breakerThreshold times in a row, so a struggling
+// Redis isn't hit by a storm of calls that time out. While open, it only lets a call through every cooldown to check
+// whether the store recovered. Gets are served from the last values read or written when the store can't be reached,
+// keeping up to fallbackSize of them.
+type breakerStore struct {
+	store     Store
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	open      bool
+
+	fallbackLock sync.Mutex
+	fallback     map[string]fallbackValue
+	fallbackSize int
+
+	openCounter     metric.Int64UpDownCounter
+	rejectedCounter metric.Int64Counter
+	fallbackCounter metric.Int64Counter
+}
+
+func newBreakerStore(store Store, threshold int, cooldown time.Duration) *breakerStore {
+	openCounter, _ := o11y.Meter.Int64UpDownCounter("store.breaker.open")
+	rejectedCounter, _ := o11y.Meter.Int64Counter("store.breaker.rejected")
+	fallbackCounter, _ := o11y.Meter.Int64Counter("store.breaker.fallback")
+	return &breakerStore{
+		store:           store,
+		threshold:       threshold,
+		cooldown:        cooldown,
+		now:             time.Now,
+		fallback:        make(map[string]fallbackValue),
+		fallbackSize:    breakerFallbackSize,
+		openCounter:     openCounter,
+		rejectedCounter: rejectedCounter,
+		fallbackCounter: fallbackCounter,
+	}
+}
+
+func (s *breakerStore) Get(ctx context.Context, key string) (value []byte, err error) {
+	err = s.call(ctx, func() error {
+		value, err = s.store.Get(ctx, key)
+		return err
+	})
+	if err == nil {
+		s.storeFallback(key, value)
+		return value, nil
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	cached, ok := s.loadFallback(key)
+	if s.fallbackCounter != nil {
+		s.fallbackCounter.Add(ctx, 1, metric.WithAttributes(attribute.Bool("hit", ok)))
+	}
+	if !ok {
+		return nil, err
+	}
+	return cached, nil
+}
+
+func (s *breakerStore) Set(ctx context.Context, key string, value []byte) error {
+	err := s.call(ctx, func() error {
+		return s.store.Set(ctx, key, value)
+	})
+	if err != nil {
+		return err
+	}
+	s.storeFallback(key, value)
+	return nil
+}
+
+// fallbackValue is a value kept to serve gets from, along with when it was stored.
+type fallbackValue struct {
+	value  []byte
+	stored time.Time
+}
+
+func (s *breakerStore) loadFallback(key string) ([]byte, bool) {
+	s.fallbackLock.Lock()
+	defer s.fallbackLock.Unlock()
+	v, ok := s.fallback[key]
+	return v.value, ok
+}
+
+// storeFallback keeps value to serve gets of key from, forgetting the least recently stored value if there are
+// fallbackSize already.
+func (s *breakerStore) storeFallback(key string, value []byte) {
+	s.fallbackLock.Lock()
+	defer s.fallbackLock.Unlock()
+
+	if _, ok := s.fallback[key]; !ok && len(s.fallback) >= s.fallbackSize {
+		oldestKey := ""
+		var oldest time.Time
+		for k, v := range s.fallback {
+			if oldestKey == "" || v.stored.Before(oldest) {
+				oldestKey, oldest = k, v.stored
+			}
+		}
+		delete(s.fallback, oldestKey)
+	}
+	s.fallback[key] = fallbackValue{value: value, stored: s.now()}
+}
+
+// call runs fn unless the breaker is open, recording its outcome. Neither a missing key nor a call aborted because ctx
+// is done, such as by a client disconnecting, is a failure of the store.
+func (s *breakerStore) call(ctx context.Context, fn func() error) error {
+	s.mu.Lock()
+	if s.open && s.now().Before(s.openUntil) {
+		s.mu.Unlock()
+		if s.rejectedCounter != nil {
+			s.rejectedCounter.Add(ctx, 1)
+		}
+		return ErrBreakerOpen
+	}
+	if s.open {
+		// Only one call is let through per cooldown while the store is checked.
+		s.openUntil = s.now().Add(s.cooldown)
+	}
+	s.mu.Unlock()
+
+	err := fn()
+
+	if ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil || errors.Is(err, ErrNotFound) {
+		s.failures = 0
+		if s.open {
+			s.open = false
+			s.addOpen(ctx, -1)
+		}
+		return err
+	}
+	s.failures++
+	if s.failures >= s.threshold {
+		s.openUntil = s.now().Add(s.cooldown)
+		if !s.open {
+			s.open = true
+			s.addOpen(ctx, 1)
+		}
+	}
+	return err
+}
+
+func (s *breakerStore) addOpen(ctx context.Context, n int64) {
+	if s.openCounter != nil {
+		s.openCounter.Add(ctx, n)
+	}
+}
@@ -0,0 +1,195 @@
+package slaytherelics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"gotest.tools/v3/assert"
+
+	"github.com/MaT1g3R/slaytherelics/o11y"
+)
+
+var errFlaky = errors.New("connection refused")
+
+// flakyStore is an in memory Store failing every call while down, and those whose context is done like Redis does.
+type flakyStore struct {
+	values map[string][]byte
+	down   bool
+	calls  int
+}
+
+func (s *flakyStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.down {
+		return nil, errFlaky
+	}
+	value, ok := s.values[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *flakyStore) Set(ctx context.Context, key string, value []byte) error {
+	s.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.down {
+		return errFlaky
+	}
+	s.values[key] = value
+	return nil
+}
+
+func breakerOpenValue(t *testing.T, reader *sdkmetric.ManualReader) int64 {
+	t.Helper()
+	rm := metricdata.ResourceMetrics{}
+	assert.NilError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "store.breaker.open" {
+				continue
+			}
+			var value int64
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				value += dp.Value
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+func TestBreakerStore(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	defer func(m metric.Meter) { o11y.Meter = m }(o11y.Meter)
+	o11y.Meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	flaky := &flakyStore{values: map[string][]byte{"cached": []byte("1")}}
+	now := time.Unix(0, 0)
+	s := newBreakerStore(flaky, 3, time.Minute)
+	s.now = func() time.Time { return now }
+
+	value, err := s.Get(ctx, "cached")
+	assert.NilError(t, err)
+	assert.Equal(t, string(value), "1")
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	flaky.down = true
+	for i := 0; i < 3; i++ {
+		_, err = s.Get(ctx, "missing")
+		assert.ErrorIs(t, err, errFlaky)
+	}
+	assert.Equal(t, breakerOpenValue(t, reader), int64(1))
+
+	// Open, the store isn't called anymore and gets are served from the fallback when they can be.
+	calls := flaky.calls
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrBreakerOpen)
+	value, err = s.Get(ctx, "cached")
+	assert.NilError(t, err)
+	assert.Equal(t, string(value), "1")
+	assert.ErrorIs(t, s.Set(ctx, "key", []byte("2")), ErrBreakerOpen)
+	assert.Equal(t, flaky.calls, calls)
+
+	// A failing call after the cooldown opens the breaker for another cooldown.
+	now = now.Add(time.Minute)
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, errFlaky)
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, ErrBreakerOpen)
+	assert.Equal(t, flaky.calls, calls+1)
+	assert.Equal(t, breakerOpenValue(t, reader), int64(1))
+
+	// A successful call after the cooldown closes the breaker.
+	flaky.down = false
+	now = now.Add(time.Minute)
+	assert.NilError(t, s.Set(ctx, "key", []byte("2")))
+	value, err = s.Get(ctx, "key")
+	assert.NilError(t, err)
+	assert.Equal(t, string(value), "2")
+	assert.Equal(t, breakerOpenValue(t, reader), int64(0))
+}
+
+func TestBreakerStoreConsecutiveFailures(t *testing.T) {
+	ctx := context.Background()
+	cancel := o11y.Init("test")
+	defer cancel(ctx)
+
+	flaky := &flakyStore{values: map[string][]byte{}}
+	s := newBreakerStore(flaky, 2, time.Minute)
+
+	// Failures interrupted by a success don't open the breaker.
+	for i := 0; i < 3; i++ {
+		flaky.down = true
+		assert.ErrorIs(t, s.Set(ctx, "key", nil), errFlaky)
+		flaky.down = false
+		assert.NilError(t, s.Set(ctx, "key", nil))
+	}
+	flaky.down = true
+	assert.ErrorIs(t, s.Set(ctx, "key", nil), errFlaky)
+	assert.ErrorIs(t, s.Set(ctx, "key", nil), errFlaky)
+	assert.ErrorIs(t, s.Set(ctx, "key", nil), ErrBreakerOpen)
+}
+
+func TestBreakerStoreContextDone(t *testing.T) {
+	ctx := context.Background()
+	cancel := o11y.Init("test")
+	defer cancel(ctx)
+
+	flaky := &flakyStore{values: map[string][]byte{}, down: true}
+	s := newBreakerStore(flaky, 2, time.Minute)
+
+	// Calls aborted by their caller don't count as failures of the store.
+	canceled, cancelCtx := context.WithCancel(ctx)
+	cancelCtx()
+	expired, cancelExpired := context.WithDeadline(ctx, time.Unix(0, 0))
+	defer cancelExpired()
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, s.Set(canceled, "key", nil), context.Canceled)
+		_, err := s.Get(expired, "key")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+	assert.ErrorIs(t, s.Set(ctx, "key", nil), errFlaky)
+	assert.ErrorIs(t, s.Set(ctx, "key", nil), errFlaky)
+	assert.ErrorIs(t, s.Set(ctx, "key", nil), ErrBreakerOpen)
+}
+
+func TestBreakerStoreFallbackSize(t *testing.T) {
+	ctx := context.Background()
+	cancel := o11y.Init("test")
+	defer cancel(ctx)
+
+	flaky := &flakyStore{values: map[string][]byte{}}
+	now := time.Unix(0, 0)
+	s := newBreakerStore(flaky, 1, time.Minute)
+	s.now = func() time.Time { return now }
+	s.fallbackSize = 2
+
+	for _, key := range []string{"a", "b", "c", "b"} {
+		now = now.Add(time.Second)
+		assert.NilError(t, s.Set(ctx, key, []byte(key)))
+	}
+	assert.Equal(t, len(s.fallback), 2)
+
+	// Only the values stored last are served while the store is down.
+	flaky.down = true
+	_, err := s.Get(ctx, "a")
+	assert.ErrorIs(t, err, errFlaky)
+	for _, key := range []string{"b", "c"} {
+		value, err := s.Get(ctx, key)
+		assert.NilError(t, err)
+		assert.Equal(t, string(value), key)
+	}
+}
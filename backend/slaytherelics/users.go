@@ -22,7 +22,7 @@ import (
 
 type Users struct {
 	twitch *client.Twitch
-	rdb    *redis.Client
+	store  Store
 
 	userIDCache        SyncMap[string, string]
 	userAuthCache      SyncMap[string, string]
@@ -33,7 +33,7 @@ type Users struct {
 func NewUsers(twitch *client.Twitch, rdb *redis.Client) *Users {
 	return &Users{
 		twitch:             twitch,
-		rdb:                rdb,
+		store:              newBreakerStore(redisStore{rdb: rdb}, breakerThreshold, breakerCooldown),
 		userIDCache:        SyncMap[string, string]{},
 		userAuthCache:      SyncMap[string, string]{},
 		redisUserAuthCache: SyncMap[string, string]{},
@@ -90,7 +90,7 @@ func (s *Users) AuthenticateTwitch(ctx context.Context, code string) (user model
 		return models.User{}, "", err
 	}
 
-	err = s.rdb.Set(ctx, user.ID, userBytes, 0).Err()
+	err = s.store.Set(ctx, user.ID, userBytes)
 	if err != nil {
 		return user, token, err
 	}
@@ -116,8 +116,8 @@ func (s *Users) AuthenticateRedis(ctx context.Context, userID, token string) (us
 
 	span.SetAttributes(attribute.String("user_id", userID))
 
-	userBytes, err := s.rdb.Get(ctx, userID).Bytes()
-	if errors.Is(err, redis.Nil) {
+	userBytes, err := s.store.Get(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
 		return models.User{}, &errors2.AuthError{Err: errors.New("user not found")}
 	}
 	if err != nil {